@@ -0,0 +1,40 @@
+package main
+
+import "time"
+
+// RecordCache keeps the records found by the last listing so unchanged
+// records don't have to be listed on every update. It is only used from
+// the update loop and needs no locking.
+type RecordCache struct {
+	recs    RecordSlice
+	fetched time.Time
+	valid   bool
+}
+
+// fresh reports whether the cached records are younger than
+// -record-cache-ttl.
+func (c *RecordCache) fresh() bool {
+	return c.valid && time.Since(c.fetched) < *recordCacheTTL
+}
+
+func (c *RecordCache) set(recs RecordSlice) {
+	c.recs = recs
+	c.fetched = time.Now()
+	c.valid = true
+}
+
+// replace swaps old for rec after a successful update. In recreate mode
+// rec has a new ID, so old is looked up by its ID.
+func (c *RecordCache) replace(old, rec Record) {
+	for i, r := range c.recs {
+		if r.Record.ID == old.Record.ID {
+			c.recs[i] = rec
+			return
+		}
+	}
+}
+
+func (c *RecordCache) invalidate() {
+	c.valid = false
+	c.recs = nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// canaryLast is the value last written to the -canary record and read
+// back from it, 0 before the first check.
+var canaryLast int64
+
+// canaryError reports that the -canary record doesn't hold the value
+// written last, so DNSimple accepted an update without keeping it.
+type canaryError struct {
+	fqdn      string
+	want, got int64
+}
+
+func (e *canaryError) Error() string {
+	return fmt.Sprintf("Canary %s holds %d instead of %d, DNSimple may have dropped an update", e.fqdn, e.got, e.want)
+}
+
+// checkCanary writes the next value to the -canary TXT record and reads it
+// back. The outcome is recorded for /healthz and /metrics, and failures
+// are logged and sent to the notifiers.
+func checkCanary(ctx context.Context) {
+	err := canaryRound(ctx)
+	health.SetCanary(err)
+	if err == nil {
+		canaryChecks.Inc("ok")
+		return
+	}
+	if _, ok := err.(*canaryError); ok {
+		canaryChecks.Inc("diverged")
+	} else {
+		canaryChecks.Inc("error")
+	}
+	logError("%s", err)
+	notify(Event{
+		Kind:   EventCanaryFailed,
+		Domain: *domainName,
+		Name:   *canaryName,
+		FQDN:   recordFQDN(*canaryName, *domainName),
+		Type:   "TXT",
+		Error:  err.Error(),
+	})
+}
+
+// canaryRound checks that the canary still holds the value written last,
+// then writes one more than the highest value seen and reads it back. A
+// canary that diverged is written anyway, so the next round starts from
+// the value that is there now.
+func canaryRound(ctx context.Context) error {
+	name := recordFQDN(*canaryName, *domainName)
+	rec, current, err := readCanary(ctx)
+	if err != nil {
+		return err
+	}
+	var diverged error
+	if canaryLast > 0 && current != canaryLast {
+		diverged = &canaryError{fqdn: name, want: canaryLast, got: current}
+	}
+
+	next := current + 1
+	if canaryLast >= next {
+		next = canaryLast + 1
+	}
+	payload := buildPayload(*canaryName, "TXT", strconv.FormatInt(next, 10), *recordTTL)
+	if rec == nil {
+		_, err = createRecord(ctx, *domainName, payload)
+	} else {
+		_, err = updateRecord(ctx, *domainName, *rec, payload)
+	}
+	if err != nil {
+		return fmt.Errorf("Could not write canary %s: %s", name, err)
+	}
+
+	_, got, err := readCanary(ctx)
+	if err != nil {
+		return err
+	}
+	if got != next {
+		return &canaryError{fqdn: name, want: next, got: got}
+	}
+	canaryLast = next
+	logDebug("Canary %s holds %d", name, next)
+	return diverged
+}
+
+// readCanary returns the -canary record and its value, or nil and 0 if
+// there is none yet. It is read from -s, where it is written, as a
+// -read-server replica lagging behind would make writes look lost.
+func readCanary(ctx context.Context) (*Record, int64, error) {
+	name := recordFQDN(*canaryName, *domainName)
+	c, err := api(ctx, *domainName)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Could not read canary %s: %s", name, err)
+	}
+	c.ReadURL = ""
+	found, err := c.ListMatchingRecords(ctx, *canaryName, "TXT")
+	if err != nil {
+		return nil, 0, fmt.Errorf("Could not read canary %s: %s", name, err)
+	}
+	recs := editable(*domainName, RecordSlice(found))
+	switch len(recs) {
+	case 0:
+		return nil, 0, nil
+	case 1:
+	default:
+		return nil, 0, fmt.Errorf("Found %d TXT records %s, the canary needs a name of its own", len(recs), name)
+	}
+	content := normalizeContent("TXT", recs[0].Record.Content)
+	value, err := strconv.ParseInt(content, 10, 64)
+	if err != nil || value < 0 {
+		return nil, 0, fmt.Errorf("Canary %s holds %q, which is not a count", name, content)
+	}
+	return &recs[0], value, nil
+}
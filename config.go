@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// commandLine holds the flags given on the command line. They take
+// precedence over the config file.
+var commandLine = map[string]bool{}
+
+// configured holds the flags set by the config file.
+var configured = map[string]bool{}
+
+// secretFlags are never logged. They hold credentials, or URLs and
+// commands that commonly include them.
+var secretFlags = map[string]bool{
+	"t":              true,
+	"webhook-secret": true,
+	"slack-webhook":  true,
+	"notify-exec":    true,
+	"publish-body":   true,
+}
+
+// userinfo matches the user name and password of URLs.
+var userinfo = regexp.MustCompile(`://[^/?#@\s,]+@`)
+
+// loggableValue returns the value v of flag name as it can be logged,
+// with the credentials of any URLs in it replaced. Values of secretFlags
+// are left out entirely.
+func loggableValue(name, v string) string {
+	if secretFlags[name] {
+		return ""
+	}
+	return userinfo.ReplaceAllString(v, "://xxxxx@")
+}
+
+// isSet reports whether a flag was given on the command line or in the
+// config file.
+func isSet(name string) bool {
+	return commandLine[name] || configured[name]
+}
+
+// applyConfig sets the flags listed in the config file at path. Values
+// may be strings, numbers or booleans and are parsed like their command
+// line counterparts, lists like a flag that is given once per item.
+// References to environment variables like ${VAR} in strings are
+// expanded. Errors name the line of the setting they are about, and
+// unknown settings get the name of a flag they may be a typo of.
+func applyConfig(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// where names a position in the file for errors
+	where := func(offset int64) string {
+		return fmt.Sprintf("%s line %d", path, lineAt(data, offset))
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return fmt.Errorf("Could not parse %s: expected an object of settings", path)
+	}
+	configured = map[string]bool{}
+	seen := map[string]bool{}
+	for dec.More() {
+		offset := nextToken(data, dec.InputOffset())
+		tok, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("Could not parse %s: %s", where(syntaxOffset(err, offset)), err)
+		}
+		// Keys are always strings, the decoder rejects anything else
+		name := tok.(string)
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			return fmt.Errorf("Could not parse %s: %s", where(syntaxOffset(err, offset)), err)
+		}
+
+		fl := flag.Lookup(name)
+		if fl == nil || name == "config" {
+			if guess := similarFlag(name); guess != "" {
+				return fmt.Errorf("Unknown setting %q in %s, did you mean %q?", name, where(offset), guess)
+			}
+			return fmt.Errorf("Unknown setting %q in %s", name, where(offset))
+		}
+		if seen[name] {
+			return fmt.Errorf("Setting %q appears twice in %s", name, where(offset))
+		}
+		seen[name] = true
+		if commandLine[name] {
+			continue
+		}
+		value := fmt.Sprint(v)
+		switch v := v.(type) {
+		case nil, map[string]interface{}:
+			return fmt.Errorf("Invalid value for %q in %s: expected a string, number, boolean or list", name, where(offset))
+		case []interface{}:
+			// Lists are meant for flags that can be repeated
+			strs := make([]string, len(v))
+			for i, item := range v {
+				strs[i] = fmt.Sprint(item)
+			}
+			value = strings.Join(strs, ",")
+		case string:
+			if value, err = expandEnv(value); err != nil {
+				return fmt.Errorf("Invalid value for %q in %s: %s", name, where(offset), err)
+			}
+		}
+		if err := fl.Value.Set(value); err != nil {
+			return fmt.Errorf("Invalid value for %q in %s: %s", name, where(offset), err)
+		}
+		configured[name] = true
+	}
+	if _, err := dec.Token(); err != nil {
+		return fmt.Errorf("Could not parse %s: %s", where(syntaxOffset(err, dec.InputOffset())), err)
+	}
+	return nil
+}
+
+// syntaxOffset returns the offset of the byte a JSON syntax error is
+// about, or fallback for other errors.
+func syntaxOffset(err error, fallback int64) int64 {
+	if serr, ok := err.(*json.SyntaxError); ok && serr.Offset > 0 {
+		return serr.Offset - 1
+	}
+	return fallback
+}
+
+// nextToken skips the blanks and the comma separating values in data
+// from offset on, to where the next token starts.
+func nextToken(data []byte, offset int64) int64 {
+	for offset < int64(len(data)) && strings.IndexByte(" \t\r\n,", data[offset]) >= 0 {
+		offset++
+	}
+	return offset
+}
+
+// lineAt returns the line of data that offset falls on, counting from 1.
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// similarFlag returns the name of the flag name most likely is a typo of,
+// or "" if none is close. Case and underscores for dashes are ignored.
+func similarFlag(name string) string {
+	normalize := func(s string) string {
+		return strings.ToLower(strings.Replace(s, "_", "-", -1))
+	}
+	want := normalize(name)
+	best, bestDist := "", 0
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		d := editDistance(want, normalize(f.Name))
+		if best == "" || d < bestDist {
+			best, bestDist = f.Name, d
+		}
+	})
+	// Allow about one edit for every three characters
+	if best == "" || bestDist > len(want)/3+1 || bestDist >= len(want) {
+		return ""
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// reloadConfig re-reads the config file. Settings that were removed from
+// the file go back to their defaults. If the new config is invalid, the
+// old one stays in place, flags and what setup derived from them alike.
+func reloadConfig() {
+	old := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		old[f.Name] = f.Value.String()
+	})
+	oldConfigured := configured
+
+	flag.VisitAll(func(f *flag.Flag) {
+		if !commandLine[f.Name] {
+			f.Value.Set(f.DefValue)
+		}
+	})
+	err := applyConfig(*configFile)
+	if err == nil {
+		err = setup()
+	}
+	if err != nil {
+		for name, v := range old {
+			// Reset first so that list flags don't append to the new value
+			fl := flag.Lookup(name)
+			fl.Value.Set(fl.DefValue)
+			fl.Value.Set(v)
+		}
+		configured = oldConfigured
+		logError("Could not reload %s, keeping the old config: %s", *configFile, err)
+		return
+	}
+
+	// Flags like -bind, -http2 or -rate only apply to new clients
+	setupClients()
+
+	// The cached records may no longer be the ones that are managed
+	createdRecord = nil
+	matchCache.invalidate()
+	familyStates = map[string]*familyState{}
+	// Connectivity is probed again in case -detect-family changed
+	probedFamilies = nil
+
+	changed := false
+	flag.VisitAll(func(f *flag.Flag) {
+		if v := f.Value.String(); v != old[f.Name] {
+			changed = true
+			if secretFlags[f.Name] {
+				logInfo("Config changed: -%s", f.Name)
+				return
+			}
+			logInfo("Config changed: -%s from %q to %q", f.Name, loggableValue(f.Name, old[f.Name]), loggableValue(f.Name, v))
+		}
+	})
+	if !changed {
+		logInfo("Config unchanged")
+	}
+}
+
+// expandEnv replaces references like ${VAR} in s with the value of the
+// environment variable. Anything else, including $VAR without braces, is
+// kept as it is, so that secrets may contain a $. Unset variables are an
+// error so that a missing token doesn't silently become an empty one.
+func expandEnv(s string) (string, error) {
+	var missing []string
+	s = envRef.ReplaceAllStringFunc(s, func(ref string) string {
+		name := ref[2 : len(ref)-1]
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return v
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	return s, nil
+}
+
+// envRef matches the references to environment variables expandEnv
+// replaces.
+var envRef = regexp.MustCompile(`\$\{[A-Za-z_][A-Za-z0-9_]*\}`)
+
+// stringList is a flag that can be given several times. Each value may
+// hold several comma separated items. Setting it to "" clears it, which
+// is how reloadConfig resets it to its default.
+type stringList []string
+
+// listFlag defines a stringList flag.
+func listFlag(name, usage string) *stringList {
+	l := &stringList{}
+	flag.Var(l, name, usage)
+	return l
+}
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	if s == "" {
+		*l = nil
+		return nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+)
+
+// tracingTransport logs how long each step of setting up the connection
+// for a request takes, for -conntrace. The times are since the request
+// was sent.
+type tracingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	target := req.Method + " " + req.URL.Host + req.URL.Path
+	since := func() time.Duration {
+		return time.Since(start).Round(time.Microsecond)
+	}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				logInfo("%s: reusing connection to %s, idle for %s", target, info.Conn.RemoteAddr(), info.IdleTime)
+			}
+		},
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			logInfo("%s: DNS lookup of %s started at %s", target, info.Host, since())
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			if info.Err != nil {
+				logInfo("%s: DNS lookup failed at %s: %s", target, since(), info.Err)
+				return
+			}
+			logInfo("%s: DNS lookup done at %s: %v", target, since(), info.Addrs)
+		},
+		ConnectStart: func(network, addr string) {
+			logInfo("%s: connecting to %s at %s", target, addr, since())
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err != nil {
+				logInfo("%s: connecting to %s failed at %s: %s", target, addr, since(), err)
+				return
+			}
+			logInfo("%s: connected to %s at %s", target, addr, since())
+		},
+		TLSHandshakeStart: func() {
+			logInfo("%s: TLS handshake started at %s", target, since())
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err != nil {
+				logInfo("%s: TLS handshake failed at %s: %s", target, since(), err)
+				return
+			}
+			logInfo("%s: TLS handshake done at %s", target, since())
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			logInfo("%s: request sent at %s", target, since())
+		},
+		GotFirstResponseByte: func() {
+			logInfo("%s: first response byte at %s", target, since())
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// deleteEntry removes the records matching -n and -type, or -filter,
+// after asking for confirmation unless -yes is set.
+func deleteEntry(ctx context.Context) error {
+	if spec != nil {
+		return fmt.Errorf("delete removes the records of -n and -type and can't be used with -spec")
+	}
+	recs, err := entryRecords(ctx)
+	if err != nil {
+		return fmt.Errorf("Could not list records: %s", err)
+	}
+	recs = editable(*domainName, recs)
+	if len(recs) == 0 {
+		logInfo("No %s record %s to delete", *recordType, fqdn())
+		return nil
+	}
+
+	for _, r := range recs {
+		fmt.Printf("%s record %s (ID %d): %s\n", r.Record.Type, recordFQDN(r.Record.Name, *domainName), r.Record.ID, r.Record.Content)
+	}
+	if *dryRun {
+		return nil
+	}
+	if !*assumeYes {
+		ok, err := confirm(fmt.Sprintf("Delete %d record(s)?", len(recs)))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("Not deleting anything")
+		}
+	}
+
+	failed := 0
+	for _, r := range recs {
+		if err := deleteRecord(ctx, *domainName, r.Record.ID); err != nil {
+			logError("Could not delete record %d: %s", r.Record.ID, err)
+			failed++
+			continue
+		}
+		logSuccess("Deleted %s record %s (ID %d)", r.Record.Type, recordFQDN(r.Record.Name, *domainName), r.Record.ID)
+	}
+	if failed > 0 {
+		return fmt.Errorf("Could not delete %d of %d records", failed, len(recs))
+	}
+	return nil
+}
+
+// stdin is shared by all questions, so that answers typed ahead aren't
+// lost in the buffer of an earlier one.
+var stdin = bufio.NewReader(os.Stdin)
+
+// promptMu keeps the questions of changes made in parallel apart.
+var promptMu sync.Mutex
+
+// confirm asks question on the terminal and reports whether it was
+// answered with yes. Without a terminal to ask on, it fails and -yes is
+// needed.
+func confirm(question string) (bool, error) {
+	if !isTerminal() {
+		return false, fmt.Errorf("Not asking for confirmation without a terminal, use -yes")
+	}
+	promptMu.Lock()
+	defer promptMu.Unlock()
+	fmt.Printf("%s [y/N] ", question)
+	// A closed input counts as no
+	answer, _ := stdin.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
+
+// errDeclined is returned for a change that was declined at the
+// -interactive prompt. It has already been logged as skipped.
+var errDeclined = errors.New("declined")
+
+// approve asks whether to go ahead with action, such as creating a
+// record, if -interactive is set. Without a terminal or with -yes, the
+// action goes ahead without asking.
+func approve(action string) bool {
+	if !*interactive || *assumeYes || !isTerminal() {
+		return true
+	}
+	ok, err := confirm(action + "?")
+	return ok && err == nil
+}
+
+// isTerminal reports whether stdin is a terminal to ask questions on.
+func isTerminal() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
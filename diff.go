@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// diffEntry is a line of the diff output.
+type diffEntry struct {
+	Status    string `json:"status"`
+	Domain    string `json:"domain"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Content   string `json:"content,omitempty"`
+	Wanted    string `json:"wanted,omitempty"`
+	TTL       int    `json:"ttl,omitempty"`
+	WantedTTL int    `json:"wanted_ttl,omitempty"`
+}
+
+// diff prints, for every managed record, whether it matches what an
+// update would write. Nothing is modified. It reports whether any record
+// has drifted.
+func diff(ctx context.Context) (bool, error) {
+	domains, plans, err := planAll(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	drift := false
+	var entries []diffEntry
+	var rows [][]string
+	for _, domain := range domains {
+		for _, c := range plans[domain] {
+			status := "OK"
+			switch c.Action {
+			case actionCreate:
+				status = "MISSING"
+			case actionUpdate:
+				status = "DRIFT"
+			case actionRefresh:
+				status = "STALE"
+			case actionDelete:
+				status = "EXTRA"
+			}
+			if c.Action != actionNone {
+				drift = true
+			}
+			if *outputFormat == "table" {
+				fmt.Printf("%-8s %s\n", status, describeChange(domain, c))
+				continue
+			}
+			e := diffEntry{
+				Status:    status,
+				Domain:    domain,
+				Name:      c.New.Name,
+				Type:      c.New.Type,
+				Content:   c.Old.Record.Content,
+				Wanted:    c.New.Content,
+				TTL:       c.Old.Record.TTL,
+				WantedTTL: clampTTL(c.New.TTL),
+			}
+			if c.Action == actionDelete {
+				e.Name, e.Type = c.Old.Record.Name, c.Old.Record.Type
+			}
+			entries = append(entries, e)
+			rows = append(rows, []string{e.Status, e.Domain, e.Name, e.Type, e.Content, e.Wanted, strconv.Itoa(e.TTL), strconv.Itoa(e.WantedTTL)})
+		}
+	}
+	if *outputFormat != "table" {
+		if entries == nil {
+			entries = []diffEntry{}
+		}
+		if err := writeOutput(entries, []string{"status", "domain", "name", "type", "content", "wanted", "ttl", "wanted_ttl"}, rows); err != nil {
+			return drift, err
+		}
+	}
+	return drift, nil
+}
+
+// planAll lists the records of every managed domain and returns the
+// changes an update would make to each, with the domains in order.
+func planAll(ctx context.Context) ([]string, map[string][]Change, error) {
+	var targets map[string][]SpecRecord
+	var all []SpecRecord
+	switch {
+	case spec != nil:
+		targets = spec.byDomain()
+		all = spec.Records
+	case len(contents) > 0:
+		all = contentRecords()
+		targets = map[string][]SpecRecord{*domainName: all}
+	case *detectFamily != "":
+		var err error
+		if all, err = familyRecords(ctx); err != nil {
+			return nil, nil, err
+		}
+		targets = map[string][]SpecRecord{*domainName: all}
+	default:
+		all = []SpecRecord{{Name: *entryName, Type: *recordType, Content: autoContent}}
+		targets = map[string][]SpecRecord{*domainName: all}
+	}
+
+	ips, err := detectIPs(ctx, all)
+	if err != nil {
+		return nil, nil, err
+	}
+	if spec == nil && len(contents) > 0 {
+		if targets[*domainName], err = renderContents(all, ips); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	domains := make([]string, 0, len(targets))
+	for domain := range targets {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	plans := map[string][]Change{}
+	if spec == nil && len(contents) == 0 && *detectFamily == "" {
+		// The record of -n is planned for as updateEntry does
+		ip := ips[*recordType]
+		if ip == "" {
+			return domains, plans, nil
+		}
+		recs, err := entryRecords(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not list records of %s: %s", *domainName, err)
+		}
+		if plans[*domainName], err = planEntry(editable(*domainName, recs), ip); err != nil {
+			return nil, nil, err
+		}
+		return domains, plans, nil
+	}
+	for _, domain := range domains {
+		var recs RecordSlice
+		pruneExtra := spec != nil && *prune
+		if spec != nil {
+			recs, err = listRecords(ctx, domain)
+		} else {
+			// Only the records of -n matter. -content owns all of them,
+			// as in syncContents
+			recs, err = listMatching(ctx, domain, *entryName, "")
+			pruneExtra = len(contents) > 0
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not list records of %s: %s", domain, err)
+		}
+		recs = editable(domain, recs)
+		plans[domain] = planDomain(recs, targets[domain], ips, pruneExtra)
+	}
+	return domains, plans, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// acmeChallenge is the label ACME DNS-01 challenges are published under.
+const acmeChallenge = "_acme-challenge"
+
+// challengeName returns the name of the TXT record that proves control of
+// the host name, relative to the domain. The apex and wildcards share the
+// challenge of the name they are under.
+func challengeName(name string) string {
+	name = strings.TrimPrefix(name, "*.")
+	if name == "" || name == "*" {
+		return acmeChallenge
+	}
+	return acmeChallenge + "." + name
+}
+
+// isChallengeCommand reports whether the command is present or cleanup,
+// which can be given the name on the command line instead of -n.
+func isChallengeCommand() bool {
+	return flag.Arg(0) == "present" || flag.Arg(0) == "cleanup"
+}
+
+// challengeArgs interprets the arguments of the present and cleanup
+// commands: the challenge value, optionally preceded by the name of the
+// challenge record or the host name it is for, as DNS-01 hooks like the
+// exec provider of lego pass them. Names must be fully qualified within
+// -d. Without a name, the challenge is for -n. A value is required with
+// present only.
+func challengeArgs(args []string, needValue bool) (name, value string, err error) {
+	name = challengeName(*entryName)
+	switch {
+	case len(args) == 2:
+		host, err := toASCII(args[0])
+		if err != nil {
+			return "", "", err
+		}
+		// Hooks pass fully qualified names, which is nothing to warn about
+		host = strings.TrimSuffix(host, ".")
+		switch {
+		case host == *domainName:
+			host = ""
+		case strings.HasSuffix(host, "."+*domainName):
+			host = strings.TrimSuffix(host, "."+*domainName)
+		default:
+			return "", "", fmt.Errorf("%q is not within %s", args[0], *domainName)
+		}
+		if host, err = relativeName(host, *domainName); err != nil {
+			return "", "", err
+		}
+		if host != acmeChallenge && !strings.HasPrefix(host, acmeChallenge+".") {
+			host = challengeName(host)
+		}
+		name, value = host, args[1]
+	case len(args) == 1:
+		value = args[0]
+	case len(args) > 2 || needValue:
+		return "", "", fmt.Errorf("Expected [NAME] VALUE as arguments")
+	}
+	return name, value, nil
+}
+
+// presentChallenge publishes value as a TXT record for an ACME DNS-01
+// challenge. Other values already there stay, so several challenges for
+// the same name, as for a certificate covering a name and its wildcard,
+// can be answered at the same time. Presenting a value twice is harmless.
+func presentChallenge(ctx context.Context, args []string) error {
+	name, value, err := challengeArgs(args, true)
+	if err != nil {
+		return err
+	}
+	fqdn := recordFQDN(name, *domainName)
+	recs, err := listMatching(ctx, *domainName, name, "TXT")
+	if err != nil {
+		return fmt.Errorf("Could not list records: %s", err)
+	}
+	for _, r := range editable(*domainName, recs) {
+		if sameContent("TXT", r.Record.Content, value) {
+			logInfo("TXT record %s (ID %d) already holds the challenge", fqdn, r.Record.ID)
+			return nil
+		}
+	}
+	if *dryRun {
+		fmt.Printf("create TXT record %s with %s\n", fqdn, value)
+		return nil
+	}
+	if !approve(fmt.Sprintf("Create TXT record %s with %s", fqdn, value)) {
+		logSkip(skipDeclined, "Not creating TXT record %s", fqdn)
+		return nil
+	}
+
+	rec, err := createRecord(ctx, *domainName, buildPayload(name, "TXT", value, *recordTTL))
+	if err != nil {
+		return fmt.Errorf("Could not create record: %s", err)
+	}
+	logSuccess("Created TXT record %s (ID %d) for the challenge", fqdn, rec.Record.ID)
+	if *waitPropagation > 0 {
+		return waitForPropagation(ctx, []liveRecord{{*domainName, fqdn, "TXT", value}})
+	}
+	return nil
+}
+
+// cleanupChallenge removes the TXT record holding value for an ACME
+// DNS-01 challenge, or all challenge records of the name without a value.
+// Finding nothing to remove is not an error.
+func cleanupChallenge(ctx context.Context, args []string) error {
+	name, value, err := challengeArgs(args, false)
+	if err != nil {
+		return err
+	}
+	fqdn := recordFQDN(name, *domainName)
+	recs, err := listMatching(ctx, *domainName, name, "TXT")
+	if err != nil {
+		return fmt.Errorf("Could not list records: %s", err)
+	}
+	recs = editable(*domainName, recs).Where(func(r Record) bool {
+		return value == "" || sameContent("TXT", r.Record.Content, value)
+	})
+	if len(recs) == 0 {
+		logInfo("No challenge in TXT record %s to remove", fqdn)
+		return nil
+	}
+
+	failed := 0
+	for _, r := range recs {
+		if *dryRun {
+			fmt.Printf("delete TXT record %s (ID %d) with %s\n", fqdn, r.Record.ID, r.Record.Content)
+			continue
+		}
+		if !approve(fmt.Sprintf("Delete TXT record %s (ID %d) with %s", fqdn, r.Record.ID, r.Record.Content)) {
+			logSkip(skipDeclined, "Not deleting TXT record %s (ID %d)", fqdn, r.Record.ID)
+			continue
+		}
+		if err := deleteRecord(ctx, *domainName, r.Record.ID); err != nil {
+			logError("Could not delete record %d: %s", r.Record.ID, err)
+			failed++
+			continue
+		}
+		logSuccess("Deleted TXT record %s (ID %d)", fqdn, r.Record.ID)
+	}
+	if failed > 0 {
+		return fmt.Errorf("Could not delete %d of %d records", failed, len(recs))
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestChallengeArgs(t *testing.T) {
+	defer func(domain, name string) {
+		*domainName, *entryName = domain, name
+	}(*domainName, *entryName)
+	*domainName, *entryName = "example.com", "www"
+
+	tests := []struct {
+		args        []string
+		name, value string
+		ok          bool
+	}{
+		{[]string{"token"}, "_acme-challenge.www", "token", true},
+		{[]string{"example.com.", "token"}, "_acme-challenge", "token", true},
+		{[]string{"example.com", "token"}, "_acme-challenge", "token", true},
+		{[]string{"home.example.com.", "token"}, "_acme-challenge.home", "token", true},
+		{[]string{"*.home.example.com.", "token"}, "_acme-challenge.home", "token", true},
+		{[]string{"_acme-challenge.home.example.com.", "token"}, "_acme-challenge.home", "token", true},
+		{[]string{"_acme-challenge.other.org.", "token"}, "", "", false},
+		{[]string{"home.other.org", "token"}, "", "", false},
+		{[]string{"notexample.com.", "token"}, "", "", false},
+		{[]string{"home", "token"}, "", "", false},
+		{nil, "", "", false},
+		{[]string{"a", "b", "c"}, "", "", false},
+	}
+	for _, test := range tests {
+		name, value, err := challengeArgs(test.args, true)
+		if (err == nil) != test.ok || name != test.name || value != test.value {
+			t.Errorf("challengeArgs(%q) = %q, %q, %v; expected %q, %q", test.args, name, value, err, test.name, test.value)
+		}
+	}
+}
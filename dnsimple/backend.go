@@ -0,0 +1,265 @@
+package dnsimple
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Backend translates records to and from the JSON an API sends and
+// receives. Servers that mimic the DNSimple API but wrap records
+// differently can be supported by implementing it.
+type Backend interface {
+	// EncodeRecord returns the request body to create or update rec with.
+	EncodeRecord(rec Record) ([]byte, error)
+	// DecodeRecord reads a single record, as returned by a create or
+	// update.
+	DecodeRecord(r io.Reader) (Record, error)
+	// DecodeRecords reads a page of records, as returned by a listing.
+	DecodeRecords(r io.Reader) ([]Record, error)
+}
+
+// RecordScanner is implemented by backends that can decode a page of
+// records one at a time, so that a large zone doesn't have to be held in
+// memory to find a few records in it. ScanRecords calls fn with each
+// record in turn until fn returns false, and returns how many records it
+// decoded and whether fn stopped it.
+type RecordScanner interface {
+	ScanRecords(r io.Reader, fn func(Record) bool) (n int, stopped bool, err error)
+}
+
+// Built-in backends for the envelopes of the DNSimple API. V1 wraps each
+// record in {"record": ...} and sends listings as a bare array. V2 wraps
+// both in {"data": ...} and names some fields differently.
+var (
+	V1 Backend = v1Backend{}
+	V2 Backend = v2Backend{}
+)
+
+// Strict returns a variant of the built-in backend b that rejects fields
+// it doesn't know in listed records, to notice changes of the API early.
+// Other backends are returned as they are.
+func Strict(b Backend) Backend {
+	switch b.(type) {
+	case v1Backend:
+		return v1Backend{strict: true}
+	case v2Backend:
+		return v2Backend{strict: true}
+	}
+	return b
+}
+
+type v1Backend struct {
+	strict bool
+}
+
+func (v1Backend) EncodeRecord(rec Record) ([]byte, error) {
+	return json.Marshal(rec)
+}
+
+func (v1Backend) DecodeRecord(r io.Reader) (Record, error) {
+	rec := Record{}
+	err := json.NewDecoder(r).Decode(&rec)
+	return rec, err
+}
+
+func (b v1Backend) DecodeRecords(r io.Reader) ([]Record, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("Invalid JSON in record listing: %s", err)
+	}
+	if err := expectList(raw); err != nil {
+		return nil, err
+	}
+	recs := []Record{}
+	if err := unmarshal(raw, &recs, b.strict); err != nil {
+		return nil, fmt.Errorf("Unexpected records in listing: %s", err)
+	}
+	return recs, nil
+}
+
+// ScanRecords reads the listing token by token. Anything but a list, such
+// as an error object, is left to DecodeRecords to report.
+func (b v1Backend) ScanRecords(r io.Reader, fn func(Record) bool) (int, bool, error) {
+	br := bufio.NewReader(r)
+	if !startsWith(br, '[') {
+		recs, err := b.DecodeRecords(br)
+		return scanSlice(recs, fn, err)
+	}
+	dec := json.NewDecoder(br)
+	if b.strict {
+		dec.DisallowUnknownFields()
+	}
+	if _, err := dec.Token(); err != nil {
+		return 0, false, fmt.Errorf("Invalid JSON in record listing: %s", err)
+	}
+	n := 0
+	for dec.More() {
+		rec := Record{}
+		if err := dec.Decode(&rec); err != nil {
+			if _, ok := err.(*json.SyntaxError); ok || err == io.ErrUnexpectedEOF {
+				return n, false, fmt.Errorf("Invalid JSON in record listing: %s", err)
+			}
+			return n, false, fmt.Errorf("Unexpected records in listing: %s", err)
+		}
+		n++
+		if !fn(rec) {
+			return n, true, nil
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return n, false, fmt.Errorf("Invalid JSON in record listing: %s", err)
+	}
+	return n, false, nil
+}
+
+type v2Backend struct {
+	strict bool
+}
+
+func (v2Backend) EncodeRecord(rec Record) ([]byte, error) {
+	return json.Marshal(toV2(rec))
+}
+
+func (v2Backend) DecodeRecord(r io.Reader) (Record, error) {
+	var body struct {
+		Data recordV2 `json:"data"`
+	}
+	err := json.NewDecoder(r).Decode(&body)
+	return fromV2(body.Data), err
+}
+
+func (b v2Backend) DecodeRecords(r io.Reader) ([]Record, error) {
+	recs, _, err := b.decodePage(r)
+	return recs, err
+}
+
+func (b v2Backend) decodePage(r io.Reader) ([]Record, int, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, 0, fmt.Errorf("Invalid JSON in record listing: %s", err)
+	}
+	var body struct {
+		Data       json.RawMessage `json:"data"`
+		Pagination struct {
+			TotalPages int `json:"total_pages"`
+		} `json:"pagination"`
+	}
+	if err := json.Unmarshal(raw, &body); err != nil || body.Data == nil {
+		if msg := errorMessage(raw); msg != "" {
+			return nil, 0, fmt.Errorf("API returned an error: %s", msg)
+		}
+		return nil, 0, fmt.Errorf("Expected records under \"data\", got %s", describeJSON(raw))
+	}
+	if err := expectList(body.Data); err != nil {
+		return nil, 0, err
+	}
+	var data []recordV2
+	if err := unmarshal(body.Data, &data, b.strict); err != nil {
+		return nil, 0, fmt.Errorf("Unexpected records in listing: %s", err)
+	}
+	recs := []Record{}
+	for _, rec := range data {
+		recs = append(recs, fromV2(rec))
+	}
+	return recs, body.Pagination.TotalPages, nil
+}
+
+// pagedBackend is implemented by the backends whose listings say how
+// many pages there are.
+type pagedBackend interface {
+	// decodePage reads a page of records like DecodeRecords, along with
+	// the total number of pages, or 0 if it isn't given.
+	decodePage(r io.Reader) ([]Record, int, error)
+}
+
+// scanRecords calls fn with each record of a page read by b, one at a
+// time if b is a RecordScanner.
+func scanRecords(b Backend, r io.Reader, fn func(Record) bool) (int, bool, error) {
+	if s, ok := b.(RecordScanner); ok {
+		return s.ScanRecords(r, fn)
+	}
+	recs, err := b.DecodeRecords(r)
+	return scanSlice(recs, fn, err)
+}
+
+// scanSlice calls fn with each of recs as ScanRecords would, unless err
+// is set.
+func scanSlice(recs []Record, fn func(Record) bool, err error) (int, bool, error) {
+	if err != nil {
+		return 0, false, err
+	}
+	for i, rec := range recs {
+		if !fn(rec) {
+			return i + 1, true, nil
+		}
+	}
+	return len(recs), false, nil
+}
+
+// startsWith reports whether the first character of r other than white
+// space is c, without consuming it.
+func startsWith(r *bufio.Reader, c byte) bool {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return false
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			r.ReadByte()
+			continue
+		}
+		return b[0] == c
+	}
+}
+
+// unmarshal decodes data into v, failing on unknown fields if strict.
+func unmarshal(data []byte, v interface{}, strict bool) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	return dec.Decode(v)
+}
+
+// expectList makes sure raw is a JSON array. Error objects sent with a
+// success status are reported with their message.
+func expectList(raw json.RawMessage) error {
+	if bytes.HasPrefix(raw, []byte("[")) {
+		return nil
+	}
+	if msg := errorMessage(raw); msg != "" {
+		return fmt.Errorf("API returned an error: %s", msg)
+	}
+	return fmt.Errorf("Expected a list of records, got %s", describeJSON(raw))
+}
+
+// errorMessage returns the message of an error object like
+// {"message": "..."}, or "" if raw is none.
+func errorMessage(raw json.RawMessage) string {
+	obj := map[string]interface{}{}
+	if json.Unmarshal(raw, &obj) != nil {
+		return ""
+	}
+	return providerError(obj)
+}
+
+// describeJSON names the kind of value raw holds for error messages.
+func describeJSON(raw json.RawMessage) string {
+	switch {
+	case len(raw) == 0:
+		return "nothing"
+	case raw[0] == '{':
+		return "an object"
+	case raw[0] == '[':
+		return "a list"
+	case raw[0] == '"':
+		return "a string"
+	case bytes.Equal(raw, []byte("null")):
+		return "null"
+	}
+	return string(raw)
+}
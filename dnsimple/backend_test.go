@@ -0,0 +1,98 @@
+package dnsimple
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// TestEncodeRecord checks that both backends send the same record, just
+// in their own envelope.
+func TestEncodeRecord(t *testing.T) {
+	prio := NewRecord("", "MX", "mail.example.com", 3600)
+	prio.Record.Priority = 10
+	recs := []Record{
+		NewRecord("home", "A", "203.0.113.9", 60),
+		NewRecord("", "A", "203.0.113.9", 60),
+		NewRecord("home", "AAAA", "2001:db8::9", 0),
+		NewRecord("home", "TXT", `"quoted" text`, 300),
+		prio,
+	}
+	for _, rec := range recs {
+		data, err := V1.EncodeRecord(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v1 := Record{}
+		if err := json.Unmarshal(data, &v1); err != nil {
+			t.Fatalf("Invalid v1 payload %s: %s", data, err)
+		}
+
+		if data, err = V2.EncodeRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+		v2 := recordV2{}
+		if err := json.Unmarshal(data, &v2); err != nil {
+			t.Fatalf("Invalid v2 payload %s: %s", data, err)
+		}
+
+		if v1 != rec {
+			t.Errorf("v1 sends %+v for %+v", v1.Record, rec.Record)
+		}
+		if got := fromV2(v2); got != rec {
+			t.Errorf("v2 sends %+v for %+v", got.Record, rec.Record)
+		}
+	}
+}
+
+// TestStrictListings decodes listings as the API sends them with the
+// strict backends, which must know every field of them.
+func TestStrictListings(t *testing.T) {
+	tests := []struct {
+		file    string
+		backend Backend
+	}{
+		{"records-v1.json", Strict(V1)},
+		{"records-v2.json", Strict(V2)},
+	}
+	for _, test := range tests {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", test.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		recs, err := test.backend.DecodeRecords(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: %s", test.file, err)
+		}
+		if len(recs) != 3 {
+			t.Fatalf("%s: decoded %d records, expected 3", test.file, len(recs))
+		}
+		soa, mx, a := recs[0].Record, recs[1].Record, recs[2].Record
+		if soa.Type != "SOA" || !soa.SystemRecord || mx.Type != "MX" || mx.Priority != 10 || mx.SystemRecord {
+			t.Errorf("%s: decoded %+v and %+v", test.file, soa, mx)
+		}
+		if a.ID != 64784 || a.Name != "home" || a.Content != "203.0.113.9" || a.TTL != 60 || a.Updated != recs[2].Record.Created {
+			t.Errorf("%s: decoded %+v", test.file, a)
+		}
+
+		scanned := 0
+		_, _, err = scanRecords(test.backend, bytes.NewReader(data), func(Record) bool {
+			scanned++
+			return true
+		})
+		if err != nil || scanned != 3 {
+			t.Errorf("%s: scanned %d records: %v", test.file, scanned, err)
+		}
+
+		// A field the backend doesn't know is still rejected
+		unknown := bytes.Replace(data, []byte(`"content"`), []byte(`"unknown": 1, "content"`), 1)
+		if _, err := test.backend.DecodeRecords(bytes.NewReader(unknown)); err == nil {
+			t.Errorf("%s: unknown field was accepted", test.file)
+		}
+		if _, _, err := scanRecords(test.backend, bytes.NewReader(unknown), func(Record) bool { return true }); err == nil {
+			t.Errorf("%s: unknown field was accepted when scanning", test.file)
+		}
+	}
+}
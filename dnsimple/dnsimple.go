@@ -0,0 +1,452 @@
+// Package dnsimple manages the records of a domain through the DNSimple
+// v1 or v2 API and looks up the external IP they are meant to point to.
+package dnsimple
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Record is a DNS record as the API sends and receives it.
+type Record struct {
+	Record struct {
+		ID       int    `json:"id,omitempty"`
+		Name     string `json:"name"`
+		TTL      int    `json:"ttl,omitempty"`
+		Created  string `json:"created_at,omitempty"`
+		Updated  string `json:"updated_at,omitempty"`
+		DomainID int    `json:"domain_id,omitempty"`
+		// ParentID is the record this one was derived from, such as the
+		// ALIAS a record of the zone was generated for.
+		ParentID int    `json:"parent_id,omitempty"`
+		Content  string `json:"content"`
+		Type     string `json:"record_type"`
+		Priority int    `json:"prio,omitempty"`
+		// SystemRecord marks records DNSimple manages itself, such as the
+		// SOA and NS records of the zone. They can't be changed.
+		SystemRecord bool `json:"system_record,omitempty"`
+	} `json:"record"`
+}
+
+// NewRecord returns a record to create or update with.
+func NewRecord(name, typ, content string, ttl int) Record {
+	rec := Record{}
+	rec.Record.Name = name
+	rec.Record.Type = typ
+	rec.Record.Content = content
+	rec.Record.TTL = ttl
+	return rec
+}
+
+// ErrConflict is returned by UpdateRecord if the record was changed
+// since it was listed.
+var ErrConflict = errors.New("Record was modified since it was listed")
+
+// MaxPerPage is the largest page size the API accepts.
+const MaxPerPage = 100
+
+// MaxPages is the most pages a listing of records or domains is read to.
+const MaxPages = 1000
+
+// Client manages the records of a single domain.
+type Client struct {
+	// BaseURL is the scheme and host of the API.
+	BaseURL string
+	// ReadURL is the scheme and host to send listings to instead, such
+	// as a caching replica of the API. BaseURL is used if empty.
+	ReadURL string
+	Domain  string
+	// Token is the domain token for v1, or the account or user token
+	// for v2, sent with every request.
+	Token string
+	// Version is the API version, 1 or 2. 1 is used if 0.
+	Version int
+	// Account is the ID of the account the domain belongs to. v2 needs
+	// it; DiscoverAccount can find it.
+	Account string
+	// Backend encodes and decodes records. The one matching Version is
+	// used if nil.
+	Backend Backend
+	// StrictJSON rejects listed records with fields the backend doesn't
+	// know. Only the built-in backends support it.
+	StrictJSON bool
+	// HTTPClient sends the requests. http.DefaultClient is used if nil.
+	HTTPClient *http.Client
+	// PerPage is the number of records asked for per request when
+	// listing. MaxPerPage is used if 0.
+	PerPage int
+	// CloseConnections closes each connection after its request instead
+	// of keeping it for the next one.
+	CloseConnections bool
+}
+
+// NewClient returns a client for domain on the public API.
+func NewClient(domain, token string) *Client {
+	return &Client{
+		BaseURL: "https://api.dnsimple.com",
+		Domain:  domain,
+		Token:   token,
+	}
+}
+
+// ListRecords returns all records of the domain, fetching them page by
+// page from ReadURL if set.
+func (c *Client) ListRecords(ctx context.Context) ([]Record, error) {
+	return c.listRecords(ctx, url.Values{})
+}
+
+// ListMatchingRecords returns the records of the domain named name and,
+// unless typ is empty, of type typ. v2 filters on the server, which saves
+// fetching all of a large zone; v1 can't and lists every record, but only
+// the matches are kept. The records are checked here either way, in case
+// a server ignores the filter.
+func (c *Client) ListMatchingRecords(ctx context.Context, name, typ string) ([]Record, error) {
+	matches := []Record{}
+	err := c.scanRecords(ctx, c.matchQuery(name, typ), func(rec Record) bool {
+		if rec.Record.Name == name && (typ == "" || rec.Record.Type == typ) {
+			matches = append(matches, rec)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
+
+// FindRecord returns the first record of the domain named name and of
+// type typ, and whether there is one. Unlike ListMatchingRecords, it
+// stops reading the listing at the first match.
+func (c *Client) FindRecord(ctx context.Context, name, typ string) (Record, bool, error) {
+	var found Record
+	ok := false
+	err := c.scanRecords(ctx, c.matchQuery(name, typ), func(rec Record) bool {
+		if rec.Record.Name == name && rec.Record.Type == typ {
+			found, ok = rec, true
+		}
+		return !ok
+	})
+	return found, ok, err
+}
+
+func (c *Client) listRecords(ctx context.Context, query url.Values) ([]Record, error) {
+	recs := []Record{}
+	err := c.scanRecords(ctx, query, func(rec Record) bool {
+		recs = append(recs, rec)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+// matchQuery returns the query asking the server to only list records
+// named name of type typ, where it can.
+func (c *Client) matchQuery(name, typ string) url.Values {
+	query := url.Values{}
+	if c.Version == 2 {
+		// The apex has an empty name, which can't be told apart from no
+		// filter, so only the type narrows the listing then
+		if name != "" {
+			query.Set("name", name)
+		}
+		if typ != "" {
+			query.Set("type", typ)
+		}
+	}
+	return query
+}
+
+// scanRecords calls fn with the records of the listing for query one at
+// a time, page by page, until fn returns false. Records are decoded as
+// they arrive where the backend supports it, and not kept.
+//
+// The listing ends with the last page the server says there is. Without
+// that, a short page is the last one. A page starting with the same
+// record as the one before means the server ignores pagination and sent
+// everything already. Listings longer than MaxPages are an error rather
+// than followed forever.
+func (c *Client) scanRecords(ctx context.Context, query url.Values, fn func(Record) bool) error {
+	perPage := c.PerPage
+	if perPage == 0 {
+		perPage = MaxPerPage
+	}
+	prevFirst := 0
+	for page := 1; page <= MaxPages; page++ {
+		resp, err := c.getRecordsPage(ctx, query, page, perPage)
+		if err != nil {
+			return err
+		}
+		first, repeated := 0, false
+		n, total, stopped, err := c.scanPage(resp, func(rec Record) bool {
+			if first == 0 {
+				first = rec.Record.ID
+				if repeated = page > 1 && first != 0 && first == prevFirst; repeated {
+					return false
+				}
+			}
+			return fn(rec)
+		})
+		resp.Body.Close()
+		switch {
+		case err != nil || repeated || stopped:
+			return err
+		case total > 0 && page >= total:
+			return nil
+		case total == 0 && n != perPage:
+			return nil
+		}
+		prevFirst = first
+	}
+	return fmt.Errorf("Record listing has more than %d pages", MaxPages)
+}
+
+// scanPage calls fn with the records of a page of the listing in resp, as
+// scanRecords of the backend does. It also returns the number of pages
+// the server says there are, or 0 if it doesn't.
+func (c *Client) scanPage(resp *http.Response, fn func(Record) bool) (n, total int, stopped bool, err error) {
+	total = pagesHeader(resp.Header)
+	if pb, ok := c.backend().(pagedBackend); ok {
+		recs, pages, err := pb.decodePage(resp.Body)
+		if pages > 0 {
+			total = pages
+		}
+		n, stopped, err = scanSlice(recs, fn, err)
+		return n, total, stopped, err
+	}
+	n, stopped, err = scanRecords(c.backend(), resp.Body, fn)
+	return n, total, stopped, err
+}
+
+// pagesHeader returns the total_pages of the X-Pagination header some
+// servers send with v1 listings, or 0 if there is none.
+func pagesHeader(h http.Header) int {
+	var pagination struct {
+		TotalPages int `json:"total_pages"`
+	}
+	if json.Unmarshal([]byte(h.Get("X-Pagination")), &pagination) != nil {
+		return 0
+	}
+	return pagination.TotalPages
+}
+
+// getRecordsPage requests a page of the listing for query. The caller
+// closes the body.
+func (c *Client) getRecordsPage(ctx context.Context, query url.Values, page, perPage int) (*http.Response, error) {
+	query.Set("page", strconv.Itoa(page))
+	query.Set("per_page", strconv.Itoa(perPage))
+	req, _ := http.NewRequestWithContext(ctx, "GET", c.readBase()+c.recordsPath()+"?"+query.Encode(), nil)
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		defer resp.Body.Close()
+		return nil, apiError("Record listing failed", resp)
+	}
+	return resp, nil
+}
+
+// CheckDomain makes sure the domain exists and the token grants access
+// to it.
+func (c *Client) CheckDomain(ctx context.Context) error {
+	url := c.url("/v1/domains/%s", c.Domain)
+	if c.Version == 2 {
+		url = c.url("/v2/%s/domains/%s", c.Account, c.Domain)
+	}
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200:
+		return nil
+	case 401:
+		return apiError("Token rejected", resp)
+	case 404:
+		return apiError("Domain not found", resp)
+	}
+	return apiError("Domain lookup failed", resp)
+}
+
+// CreateRecord adds rec to the domain and returns it as created.
+func (c *Client) CreateRecord(ctx context.Context, rec Record) (Record, error) {
+	data, err := c.backend().EncodeRecord(rec)
+	if err != nil {
+		return Record{}, err
+	}
+	req, _ := http.NewRequestWithContext(ctx, "POST", c.recordsURL(), bytes.NewReader(data))
+	resp, err := c.do(req)
+	if err != nil {
+		return Record{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 201 {
+		return Record{}, apiError("Record creation failed", resp)
+	}
+
+	created, err := c.backend().DecodeRecord(resp.Body)
+	if err != nil {
+		return Record{}, fmt.Errorf("Could not decode created record: %s", err)
+	}
+	return created, nil
+}
+
+// UpdateRecord replaces old with rec. The update is conditional on old
+// not having changed in the meantime.
+func (c *Client) UpdateRecord(ctx context.Context, old Record, rec Record) (Record, error) {
+	// v2 updates only the fields that are sent and can't change the type,
+	// v1 replaces the whole record
+	method, body := "PUT", rec
+	if c.Version == 2 {
+		method = "PATCH"
+		body.Record.Type = ""
+	}
+	data, err := c.backend().EncodeRecord(body)
+	if err != nil {
+		return Record{}, err
+	}
+	req, _ := http.NewRequestWithContext(ctx, method, c.recordURL(old.Record.ID), bytes.NewReader(data))
+	if updated, err := time.Parse(time.RFC3339, old.Record.Updated); err == nil {
+		req.Header.Set("If-Unmodified-Since", updated.UTC().Format(http.TimeFormat))
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return Record{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 412 {
+		return Record{}, ErrConflict
+	}
+	if resp.StatusCode != 200 {
+		return Record{}, apiError("Record update failed", resp)
+	}
+
+	// If the server doesn't send the updated record, what was sent is
+	// close enough.
+	updated, err := c.backend().DecodeRecord(resp.Body)
+	if err != nil || updated.Record.ID == 0 {
+		updated = rec
+		updated.Record.ID = old.Record.ID
+	}
+	return updated, nil
+}
+
+// DeleteRecord removes the record with the given ID.
+func (c *Client) DeleteRecord(ctx context.Context, id int) error {
+	req, _ := http.NewRequestWithContext(ctx, "DELETE", c.recordURL(id), nil)
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 && resp.StatusCode != 204 {
+		return apiError("Record deletion failed", resp)
+	}
+	return nil
+}
+
+// Sync points the record with the given name and type at ip, creating
+// it if there is none. It refuses to pick one of several matching
+// records.
+func (c *Client) Sync(ctx context.Context, name, typ, ip string, ttl int) (Record, error) {
+	recs, err := c.ListRecords(ctx)
+	if err != nil {
+		return Record{}, err
+	}
+	var matches []Record
+	for _, r := range recs {
+		if r.Record.Name == name && r.Record.Type == typ && !r.Record.SystemRecord {
+			matches = append(matches, r)
+		}
+	}
+
+	rec := NewRecord(name, typ, ip, ttl)
+	switch len(matches) {
+	case 0:
+		return c.CreateRecord(ctx, rec)
+	case 1:
+		if matches[0].Record.Content == ip && (ttl == 0 || matches[0].Record.TTL == ttl) {
+			return matches[0], nil
+		}
+		return c.UpdateRecord(ctx, matches[0], rec)
+	}
+	return Record{}, fmt.Errorf("%d %s records named %q", len(matches), typ, name)
+}
+
+func (c *Client) url(path string, args ...interface{}) string {
+	return c.BaseURL + fmt.Sprintf(path, args...)
+}
+
+// readBase returns the scheme and host to send listings to.
+func (c *Client) readBase() string {
+	if c.ReadURL != "" {
+		return c.ReadURL
+	}
+	return c.BaseURL
+}
+
+func (c *Client) recordsPath() string {
+	if c.Version == 2 {
+		return fmt.Sprintf("/v2/%s/zones/%s/records", c.Account, c.Domain)
+	}
+	return fmt.Sprintf("/v1/domains/%s/records", c.Domain)
+}
+
+func (c *Client) recordsURL() string {
+	return c.BaseURL + c.recordsPath()
+}
+
+func (c *Client) recordURL(id int) string {
+	return c.recordsURL() + fmt.Sprintf("/%d", id)
+}
+
+// backend returns the Backend to use, the one matching Version unless
+// set explicitly.
+func (c *Client) backend() Backend {
+	b := V1
+	switch {
+	case c.Backend != nil:
+		b = c.Backend
+	case c.Version == 2:
+		b = V2
+	}
+	if c.StrictJSON {
+		return Strict(b)
+	}
+	return b
+}
+
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	req.Header.Add("Accepts", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+	if c.Version == 2 {
+		req.Header.Add("Authorization", "Bearer "+c.Token)
+	} else {
+		req.Header.Add("X-DNSimple-Domain-Token", c.Token)
+	}
+	req.Close = c.CloseConnections
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// apiError describes an unexpected API response, naming the request it
+// answered. The token is sent in a header and does not show up here.
+func apiError(what string, resp *http.Response) error {
+	req := resp.Request
+	return fmt.Errorf("%s: %s %s: %s (%d)", what, req.Method, req.URL.Redacted(), resp.Status, resp.StatusCode)
+}
@@ -0,0 +1,171 @@
+package dnsimple_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/surma-dump/dnsimple-updater/dnsimple"
+	"github.com/surma-dump/dnsimple-updater/dnsimple/dnsimpletest"
+)
+
+// TestListRecordsPaging lists zones of different sizes from servers that
+// do and don't implement pagination.
+func TestListRecordsPaging(t *testing.T) {
+	tests := []struct {
+		version      int
+		records      int
+		ignorePaging bool
+		wantRequests int
+	}{
+		{1, 0, false, 1},
+		{1, 5, false, 1},
+		{1, 100, false, 2},
+		{1, 250, false, 3},
+		{1, 5, true, 1},
+		{1, 100, true, 2},
+		{1, 250, true, 1},
+		{2, 0, false, 1},
+		{2, 100, false, 1},
+		{2, 250, false, 3},
+		{2, 100, true, 2},
+		{2, 250, true, 1},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("v%d/%d/ignore-paging=%t", test.version, test.records, test.ignorePaging), func(t *testing.T) {
+			srv := dnsimpletest.NewServer()
+			defer srv.Close()
+			srv.IgnorePaging = test.ignorePaging
+			for i := 0; i < test.records; i++ {
+				srv.Add("example.com", dnsimple.NewRecord(fmt.Sprintf("host%d", i), "A", "192.0.2.1", 60))
+			}
+
+			recs, err := srv.Client("example.com", test.version).ListRecords(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(recs) != test.records {
+				t.Errorf("Listed %d records, expected %d", len(recs), test.records)
+			}
+			if n := len(srv.Requests()); n != test.wantRequests {
+				t.Errorf("Sent %d requests, expected %d", n, test.wantRequests)
+			}
+		})
+	}
+}
+
+// TestListRecordsPaginationHeader ends v1 listings with the last page of
+// the X-Pagination header, even if it is full.
+func TestListRecordsPaginationHeader(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("X-Pagination", `{"current_page":1,"total_pages":1}`)
+		fmt.Fprintf(w, `[{"record":{"id":%d,"name":"a","record_type":"A","content":"192.0.2.1"}}]`, requests)
+	}))
+	defer srv.Close()
+	c := dnsimple.NewClient("example.com", "token")
+	c.BaseURL = srv.URL
+	c.PerPage = 1
+
+	recs, err := c.ListRecords(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || requests != 1 {
+		t.Errorf("Listed %d records in %d requests, expected 1 in 1", len(recs), requests)
+	}
+}
+
+// TestListRecordsEndless gives up on a server that never stops sending
+// full pages of new records.
+func TestListRecordsEndless(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprintf(w, `[{"record":{"id":%d,"name":"a","record_type":"A","content":"192.0.2.1"}}]`, requests)
+	}))
+	defer srv.Close()
+	c := dnsimple.NewClient("example.com", "token")
+	c.BaseURL = srv.URL
+	c.PerPage = 1
+
+	if _, err := c.ListRecords(context.Background()); err == nil {
+		t.Error("Endless listing was accepted")
+	}
+	if requests != dnsimple.MaxPages {
+		t.Errorf("Sent %d requests, expected %d", requests, dnsimple.MaxPages)
+	}
+}
+
+// TestListDomainsPaging lists domains from v2 servers that page properly,
+// ignore pagination or never stop sending new domains.
+func TestListDomainsPaging(t *testing.T) {
+	tests := []struct {
+		name string
+		// page returns the IDs of the domains on page and the total_pages
+		// to answer with, 0 for none
+		page         func(page int) (ids []int, total int)
+		wantDomains  int
+		wantRequests int
+		wantErr      bool
+	}{
+		{"paged", func(page int) ([]int, int) {
+			return ids(page*1000, map[int]int{1: 100, 2: 30}[page]), 2
+		}, 130, 2, false},
+		{"short page", func(page int) ([]int, int) {
+			return ids(page*1000, map[int]int{1: 100, 2: 100, 3: 5}[page]), 0
+		}, 205, 3, false},
+		{"ignoring pages", func(page int) ([]int, int) {
+			return ids(0, 100), 0
+		}, 100, 2, false},
+		{"endless", func(page int) ([]int, int) {
+			return ids(page*1000, 100), page + 1
+		}, 0, dnsimple.MaxPages, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requests := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+				domains, total := test.page(page)
+				var data []string
+				for _, id := range domains {
+					data = append(data, fmt.Sprintf(`{"id":%d,"name":"d%d.example"}`, id, id))
+				}
+				fmt.Fprintf(w, `{"data":[%s]`, strings.Join(data, ","))
+				if total > 0 {
+					fmt.Fprintf(w, `,"pagination":{"current_page":%d,"total_pages":%d}`, page, total)
+				}
+				fmt.Fprint(w, "}")
+			}))
+			defer srv.Close()
+			c := dnsimple.NewClient("", "token")
+			c.BaseURL = srv.URL
+			c.Version = 2
+			c.Account = dnsimpletest.Account
+
+			domains, err := c.ListDomains(context.Background())
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Listing failed with %v", err)
+			}
+			if len(domains) != test.wantDomains || requests != test.wantRequests {
+				t.Errorf("Listed %d domains in %d requests, expected %d in %d", len(domains), requests, test.wantDomains, test.wantRequests)
+			}
+		})
+	}
+}
+
+// ids returns n IDs counting up from from+1.
+func ids(from, n int) []int {
+	var ids []int
+	for i := 1; i <= n; i++ {
+		ids = append(ids, from+i)
+	}
+	return ids
+}
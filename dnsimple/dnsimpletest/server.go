@@ -0,0 +1,287 @@
+// Package dnsimpletest provides a stand-in for the DNSimple API to test
+// against, in the spirit of net/http/httptest.
+package dnsimpletest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/surma-dump/dnsimple-updater/dnsimple"
+)
+
+// Account is the ID of the account the v2 API of the server answers for.
+const Account = "1010"
+
+// Request is a request the server received.
+type Request struct {
+	Method string
+	// Path is the path of the URL, without the query.
+	Path  string
+	Query url.Values
+	Body  []byte
+}
+
+// Server keeps the records of any number of domains in memory and serves
+// them through the v1 and v2 API. Records are created, updated and
+// deleted as the API would, and every request is recorded.
+type Server struct {
+	*httptest.Server
+
+	// IgnorePaging makes listings return all records regardless of the
+	// page asked for and without saying how many pages there are, like
+	// a server that doesn't implement pagination.
+	IgnorePaging bool
+
+	mu       sync.Mutex
+	records  map[string][]dnsimple.Record
+	nextID   int
+	requests []Request
+}
+
+// NewServer starts a server without records. It is closed with Close.
+func NewServer() *Server {
+	s := &Server{records: map[string][]dnsimple.Record{}, nextID: 1}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Client returns a client for domain on the server, using the API of
+// version 1 or 2.
+func (s *Server) Client(domain string, version int) *dnsimple.Client {
+	c := dnsimple.NewClient(domain, "token")
+	c.BaseURL = s.URL
+	c.Version = version
+	if version == 2 {
+		c.Account = Account
+	}
+	return c
+}
+
+// Host returns the host and port the server listens on.
+func (s *Server) Host() string {
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+// Add adds rec to domain, giving it the next free ID, and returns it.
+func (s *Server) Add(domain string, rec dnsimple.Record) dnsimple.Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.add(domain, rec)
+}
+
+func (s *Server) add(domain string, rec dnsimple.Record) dnsimple.Record {
+	rec.Record.ID = s.nextID
+	s.nextID++
+	s.records[domain] = append(s.records[domain], rec)
+	return rec
+}
+
+// Records returns the records of domain.
+func (s *Server) Records(domain string) []dnsimple.Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]dnsimple.Record{}, s.records[domain]...)
+}
+
+// Requests returns the requests received so far.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request{}, s.requests...)
+}
+
+// Writes returns the requests received so far that change records.
+func (s *Server) Writes() []Request {
+	var writes []Request
+	for _, r := range s.Requests() {
+		if r.Method != "GET" {
+			writes = append(writes, r)
+		}
+	}
+	return writes
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, Request{r.Method, r.URL.Path, r.URL.Query(), body})
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) >= 4 && parts[0] == "v1" && parts[1] == "domains" && parts[3] == "records":
+		s.serveRecords(w, r, 1, parts[2], parts[4:], body)
+	case len(parts) == 3 && parts[0] == "v1" && parts[1] == "domains":
+		s.serveDomain(w, parts[2])
+	case len(parts) >= 5 && parts[0] == "v2" && parts[1] == Account && parts[2] == "zones" && parts[4] == "records":
+		s.serveRecords(w, r, 2, parts[3], parts[5:], body)
+	case len(parts) == 4 && parts[0] == "v2" && parts[1] == Account && parts[2] == "domains":
+		s.serveDomain(w, parts[3])
+	case r.URL.Path == "/v2/whoami":
+		fmt.Fprintf(w, `{"data":{"account":{"id":%s},"user":null}}`, Account)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveDomain(w http.ResponseWriter, domain string) {
+	if _, ok := s.records[domain]; !ok {
+		http.Error(w, `{"message":"Domain not found"}`, 404)
+		return
+	}
+	fmt.Fprintf(w, `{"domain":{"name":%q}}`, domain)
+}
+
+func (s *Server) serveRecords(w http.ResponseWriter, r *http.Request, version int, domain string, rest []string, body []byte) {
+	if len(rest) == 0 {
+		switch r.Method {
+		case "GET":
+			s.list(w, r, version, domain)
+		case "POST":
+			rec, err := decode(version, body)
+			if err != nil {
+				http.Error(w, `{"message":"Invalid record"}`, 400)
+				return
+			}
+			w.WriteHeader(201)
+			writeRecord(w, version, s.add(domain, rec))
+		default:
+			http.Error(w, "", 405)
+		}
+		return
+	}
+
+	id, _ := strconv.Atoi(rest[0])
+	recs := s.records[domain]
+	i := 0
+	for i < len(recs) && recs[i].Record.ID != id {
+		i++
+	}
+	if i == len(recs) {
+		http.Error(w, `{"message":"Record not found"}`, 404)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeRecord(w, version, recs[i])
+	case "PUT", "PATCH":
+		rec, err := decode(version, body)
+		if err != nil {
+			http.Error(w, `{"message":"Invalid record"}`, 400)
+			return
+		}
+		old := recs[i].Record
+		recs[i] = rec
+		recs[i].Record.ID = id
+		if r.Method == "PATCH" {
+			recs[i].Record.Type = old.Type
+		}
+		writeRecord(w, version, recs[i])
+	case "DELETE":
+		s.records[domain] = append(recs[:i:i], recs[i+1:]...)
+		w.WriteHeader(204)
+	default:
+		http.Error(w, "", 405)
+	}
+}
+
+// list sends a page of the records of domain, only those matching the
+// name and type given with v2.
+func (s *Server) list(w http.ResponseWriter, r *http.Request, version int, domain string) {
+	q := r.URL.Query()
+	recs := []dnsimple.Record{}
+	for _, rec := range s.records[domain] {
+		if version == 2 && (q.Get("name") != "" && rec.Record.Name != q.Get("name") ||
+			q.Get("type") != "" && rec.Record.Type != q.Get("type")) {
+			continue
+		}
+		recs = append(recs, rec)
+	}
+
+	page, _ := strconv.Atoi(q.Get("page"))
+	perPage, _ := strconv.Atoi(q.Get("per_page"))
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 {
+		perPage = dnsimple.MaxPerPage
+	}
+	pages := (len(recs) + perPage - 1) / perPage
+	if !s.IgnorePaging {
+		from, to := (page-1)*perPage, page*perPage
+		if from > len(recs) {
+			from = len(recs)
+		}
+		if to > len(recs) {
+			to = len(recs)
+		}
+		recs = recs[from:to]
+	}
+
+	if version == 1 {
+		json.NewEncoder(w).Encode(recs)
+		return
+	}
+	data := []interface{}{}
+	for _, rec := range recs {
+		data = append(data, toV2(rec))
+	}
+	out := map[string]interface{}{"data": data}
+	if !s.IgnorePaging {
+		out["pagination"] = map[string]int{
+			"current_page":  page,
+			"per_page":      perPage,
+			"total_entries": len(s.records[domain]),
+			"total_pages":   pages,
+		}
+	}
+	json.NewEncoder(w).Encode(out)
+}
+
+// decode reads a record as sent to create or update it.
+func decode(version int, body []byte) (dnsimple.Record, error) {
+	rec := dnsimple.Record{}
+	if version == 1 {
+		err := json.Unmarshal(body, &rec)
+		return rec, err
+	}
+	var r struct {
+		Name     string `json:"name"`
+		Content  string `json:"content"`
+		TTL      int    `json:"ttl"`
+		Priority int    `json:"priority"`
+		Type     string `json:"type"`
+	}
+	err := json.Unmarshal(body, &r)
+	rec = dnsimple.NewRecord(r.Name, r.Type, r.Content, r.TTL)
+	rec.Record.Priority = r.Priority
+	return rec, err
+}
+
+// writeRecord sends rec as the API returns a single record.
+func writeRecord(w http.ResponseWriter, version int, rec dnsimple.Record) {
+	if version == 1 {
+		json.NewEncoder(w).Encode(rec)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": toV2(rec)})
+}
+
+func toV2(rec dnsimple.Record) map[string]interface{} {
+	return map[string]interface{}{
+		"id":            rec.Record.ID,
+		"name":          rec.Record.Name,
+		"content":       rec.Record.Content,
+		"ttl":           rec.Record.TTL,
+		"priority":      rec.Record.Priority,
+		"type":          rec.Record.Type,
+		"system_record": rec.Record.SystemRecord,
+	}
+}
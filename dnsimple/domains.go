@@ -0,0 +1,65 @@
+package dnsimple
+
+import (
+	"context"
+	"fmt"
+)
+
+// Domain is a domain as listed by ListDomains.
+type Domain struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	// UnicodeName is Name with internationalized labels decoded.
+	UnicodeName string `json:"unicode_name,omitempty"`
+	State       string `json:"state,omitempty"`
+}
+
+// ListDomains returns the domains the token has access to, asking ReadURL
+// if set. The Domain of the client is ignored. v1 domain tokens only
+// grant access to their own domain and are rejected by the API.
+//
+// v2 listings are paged through as records are, up to MaxPages.
+func (c *Client) ListDomains(ctx context.Context) ([]Domain, error) {
+	if c.Version != 2 {
+		var body []struct {
+			Domain Domain `json:"domain"`
+		}
+		if err := c.getJSON(ctx, c.readBase()+"/v1/domains", &body); err != nil {
+			return nil, err
+		}
+		domains := []Domain{}
+		for _, d := range body {
+			domains = append(domains, d.Domain)
+		}
+		return domains, nil
+	}
+
+	domains := []Domain{}
+	prevFirst := 0
+	for page := 1; page <= MaxPages; page++ {
+		var body struct {
+			Data       []Domain `json:"data"`
+			Pagination struct {
+				TotalPages int `json:"total_pages"`
+			} `json:"pagination"`
+		}
+		path := fmt.Sprintf("/v2/%s/domains?page=%d&per_page=%d", c.Account, page, MaxPerPage)
+		if err := c.getJSON(ctx, c.readBase()+path, &body); err != nil {
+			return nil, err
+		}
+		total := body.Pagination.TotalPages
+		if len(body.Data) > 0 && page > 1 && body.Data[0].ID != 0 && body.Data[0].ID == prevFirst {
+			// The server ignores pagination and sent everything already
+			return domains, nil
+		}
+		domains = append(domains, body.Data...)
+		switch {
+		case total > 0 && page >= total:
+			return domains, nil
+		case total == 0 && len(body.Data) != MaxPerPage:
+			return domains, nil
+		}
+		prevFirst = body.Data[0].ID
+	}
+	return nil, fmt.Errorf("Domain listing has more than %d pages", MaxPages)
+}
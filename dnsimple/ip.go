@@ -0,0 +1,114 @@
+package dnsimple
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// StatusError is returned by the HTTP providers when the service answers
+// with another status than 200, so callers can tell a provider that is
+// briefly overloaded from one that rejects the request.
+type StatusError struct {
+	Code   int
+	Status string
+	// Message is the error description the provider sent, if any.
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("Provider returned %s: %s", e.Status, e.Message)
+	}
+	return fmt.Sprintf("Provider returned %s", e.Status)
+}
+
+// LookupIP asks the provider at url for the caller's IP. The provider
+// answers with a JSON object holding it as "ip", like jsonip.com does.
+// client is used for the request, http.DefaultClient if nil.
+func LookupIP(ctx context.Context, client *http.Client, url string) (string, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	obj := map[string]interface{}{}
+	decodeErr := json.NewDecoder(resp.Body).Decode(&obj)
+	msg := providerError(obj)
+	if resp.StatusCode != 200 {
+		return "", &StatusError{Code: resp.StatusCode, Status: resp.Status, Message: msg}
+	}
+	if decodeErr != nil {
+		return "", decodeErr
+	}
+	rawIp, ok := obj["ip"]
+	if !ok {
+		if msg != "" {
+			return "", fmt.Errorf("Provider error: %s", msg)
+		}
+		return "", fmt.Errorf("No IP field in response")
+	}
+	ip, ok := rawIp.(string)
+	if !ok {
+		return "", fmt.Errorf("IP has unexpected type")
+	}
+	if net.ParseIP(ip) == nil {
+		return "", fmt.Errorf("Invalid IP %q", ip)
+	}
+	return ip, nil
+}
+
+// LookupIPHeader asks the service at url for the caller's IP like
+// LookupIP, but takes it from the response header instead of the body.
+// The header may hold a comma separated list of addresses, as
+// X-Forwarded-For does. The first of them that skip doesn't reject is
+// returned. skip may be nil.
+func LookupIPHeader(ctx context.Context, client *http.Client, url, header string, skip func(net.IP) bool) (string, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", &StatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+
+	values := resp.Header.Values(header)
+	if len(values) == 0 {
+		return "", fmt.Errorf("No %s header in response", header)
+	}
+	for _, hop := range strings.Split(strings.Join(values, ","), ",") {
+		hop = strings.TrimSpace(hop)
+		ip := net.ParseIP(hop)
+		if ip == nil {
+			return "", fmt.Errorf("Invalid IP %q in %s header", hop, header)
+		}
+		if skip == nil || !skip(ip) {
+			return ip.String(), nil
+		}
+	}
+	return "", fmt.Errorf("No usable IP in %s header %q", header, strings.Join(values, ", "))
+}
+
+// providerError extracts the error description some providers send
+// instead of an IP.
+func providerError(obj map[string]interface{}) string {
+	for _, key := range []string{"error", "message"} {
+		if v, ok := obj[key]; ok {
+			return fmt.Sprint(v)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,77 @@
+package dnsimple_test
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/surma-dump/dnsimple-updater/dnsimple"
+	"github.com/surma-dump/dnsimple-updater/dnsimple/dnsimpletest"
+)
+
+var update = flag.Bool("update", false, "Rewrite the golden files with the payloads sent")
+
+// TestPayloads compares the bodies of creates and updates with the
+// golden files in testdata/payloads. Run with -update to accept changes.
+func TestPayloads(t *testing.T) {
+	tests := []struct {
+		golden  string
+		version int
+		rec     dnsimple.Record
+		// update the record with rec instead of creating it
+		update bool
+	}{
+		{"v1-create-a", 1, dnsimple.NewRecord("home", "A", "203.0.113.9", 60), false},
+		{"v1-create-aaaa", 1, dnsimple.NewRecord("home", "AAAA", "2001:db8::9", 60), false},
+		{"v1-create-apex", 1, dnsimple.NewRecord("", "A", "203.0.113.9", 60), false},
+		{"v1-create-default-ttl", 1, dnsimple.NewRecord("home", "A", "203.0.113.9", 0), false},
+		{"v1-create-long-ttl", 1, dnsimple.NewRecord("home", "A", "203.0.113.9", 86400), false},
+		{"v1-update-a", 1, dnsimple.NewRecord("home", "A", "203.0.113.10", 60), true},
+		{"v1-update-aaaa", 1, dnsimple.NewRecord("home", "AAAA", "2001:db8::10", 60), true},
+		{"v1-update-default-ttl", 1, dnsimple.NewRecord("home", "A", "203.0.113.10", 0), true},
+		{"v2-create-a", 2, dnsimple.NewRecord("home", "A", "203.0.113.9", 60), false},
+		{"v2-create-aaaa", 2, dnsimple.NewRecord("home", "AAAA", "2001:db8::9", 60), false},
+		{"v2-create-default-ttl", 2, dnsimple.NewRecord("home", "A", "203.0.113.9", 0), false},
+		{"v2-update-a", 2, dnsimple.NewRecord("home", "A", "203.0.113.10", 60), true},
+		{"v2-update-aaaa", 2, dnsimple.NewRecord("home", "AAAA", "2001:db8::10", 3600), true},
+	}
+	for _, test := range tests {
+		t.Run(test.golden, func(t *testing.T) {
+			srv := dnsimpletest.NewServer()
+			defer srv.Close()
+			c := srv.Client("example.com", test.version)
+			var err error
+			if test.update {
+				old := srv.Add("example.com", dnsimple.NewRecord("home", test.rec.Record.Type, "192.0.2.1", 60))
+				_, err = c.UpdateRecord(context.Background(), old, test.rec)
+			} else {
+				_, err = c.CreateRecord(context.Background(), test.rec)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			writes := srv.Writes()
+			if len(writes) != 1 {
+				t.Fatalf("Sent %d requests, expected 1", len(writes))
+			}
+			got := append([]byte(writes[0].Method+" "+writes[0].Path+"\n"), writes[0].Body...)
+			path := filepath.Join("testdata", "payloads", test.golden+".golden")
+			if *update {
+				if err := ioutil.WriteFile(path, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("Sent\n%s\nexpected\n%s", got, want)
+			}
+		})
+	}
+}
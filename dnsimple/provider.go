@@ -0,0 +1,210 @@
+package dnsimple
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// IPProvider finds out the external IP of the host.
+type IPProvider interface {
+	// ExternalIP returns the external address of family 4 or 6, or of
+	// either family if 0. Providers that can't choose the family may
+	// return an address of the other one.
+	ExternalIP(ctx context.Context, family int) (net.IP, error)
+	// String names the provider in logs and metrics.
+	String() string
+}
+
+// HTTPJSONProvider asks a service like jsonip.com, which answers with a
+// JSON object holding the caller's IP as "ip".
+type HTTPJSONProvider struct {
+	URL string
+	// Client is used for the request, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+func (p *HTTPJSONProvider) ExternalIP(ctx context.Context, family int) (net.IP, error) {
+	ip, err := LookupIP(ctx, p.Client, p.URL)
+	if err != nil {
+		return nil, err
+	}
+	return net.ParseIP(ip), nil
+}
+
+func (p *HTTPJSONProvider) String() string {
+	return p.URL
+}
+
+// HTTPTextProvider asks a service like icanhazip.com, which answers with
+// nothing but the caller's IP.
+type HTTPTextProvider struct {
+	URL string
+	// Client is used for the request, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+func (p *HTTPTextProvider) ExternalIP(ctx context.Context, family int) (net.IP, error) {
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, _ := http.NewRequestWithContext(ctx, "GET", p.URL, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, &StatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+	// Anything longer than this isn't an address
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64))
+	if err != nil {
+		return nil, err
+	}
+	return parseIP(strings.TrimSpace(string(body)))
+}
+
+func (p *HTTPTextProvider) String() string {
+	return p.URL
+}
+
+// HTTPHeaderProvider takes the caller's IP from a header of the response
+// of a service, as LookupIPHeader does.
+type HTTPHeaderProvider struct {
+	URL    string
+	Header string
+	// Skip rejects addresses in the header, such as those of proxies. It
+	// may be nil.
+	Skip func(net.IP) bool
+	// Client is used for the request, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+func (p *HTTPHeaderProvider) ExternalIP(ctx context.Context, family int) (net.IP, error) {
+	ip, err := LookupIPHeader(ctx, p.Client, p.URL, p.Header, p.Skip)
+	if err != nil {
+		return nil, err
+	}
+	return net.ParseIP(ip), nil
+}
+
+func (p *HTTPHeaderProvider) String() string {
+	return p.URL
+}
+
+// DNSProvider resolves a name that a DNS server answers with the address
+// the query came from, such as myip.opendns.com on resolver1.opendns.com.
+type DNSProvider struct {
+	Name string
+	// Server is the host name or address of the DNS server to ask.
+	Server string
+}
+
+func (p *DNSProvider) ExternalIP(ctx context.Context, family int) (net.IP, error) {
+	network := "ip"
+	if family != 0 {
+		network = fmt.Sprintf("ip%d", family)
+	}
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, proto, _ string) (net.Conn, error) {
+			// Ask over the family that should be found out
+			if family != 0 {
+				proto += fmt.Sprint(family)
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, proto, net.JoinHostPort(p.Server, "53"))
+		},
+	}
+	ips, err := r.LookupIP(ctx, network, p.Name)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+func (p *DNSProvider) String() string {
+	return "dns:" + p.Name + "@" + p.Server
+}
+
+// InterfaceProvider takes the address of a network interface, for hosts
+// that hold their public address themselves.
+type InterfaceProvider struct {
+	Name string
+}
+
+func (p *InterfaceProvider) ExternalIP(ctx context.Context, family int) (net.IP, error) {
+	iface, err := net.InterfaceByName(p.Name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		n, ok := addr.(*net.IPNet)
+		if !ok || !n.IP.IsGlobalUnicast() {
+			continue
+		}
+		if isIPv4 := n.IP.To4() != nil; family == 4 && !isIPv4 || family == 6 && isIPv4 {
+			continue
+		}
+		return n.IP, nil
+	}
+	return nil, fmt.Errorf("No suitable address on %s", p.Name)
+}
+
+func (p *InterfaceProvider) String() string {
+	return "iface:" + p.Name
+}
+
+// FileProvider reads the IP from a file written by another process. A
+// file that is still being written won't parse and is reported as an
+// error.
+type FileProvider struct {
+	Path string
+}
+
+func (p *FileProvider) ExternalIP(ctx context.Context, family int) (net.IP, error) {
+	data, err := ioutil.ReadFile(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := parseIP(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%s in %s", err, p.Path)
+	}
+	return ip, nil
+}
+
+func (p *FileProvider) String() string {
+	return "file:" + p.Path
+}
+
+// StaticProvider always returns the same IP.
+type StaticProvider struct {
+	IP net.IP
+}
+
+func (p *StaticProvider) ExternalIP(ctx context.Context, family int) (net.IP, error) {
+	return p.IP, nil
+}
+
+func (p *StaticProvider) String() string {
+	return "static:" + p.IP.String()
+}
+
+func parseIP(s string) (net.IP, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid IP %q", s)
+	}
+	return ip, nil
+}
@@ -0,0 +1,105 @@
+package dnsimple
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// recordV2 is a record as the v2 API sends and receives it.
+type recordV2 struct {
+	ID       int    `json:"id,omitempty"`
+	ZoneID   string `json:"zone_id,omitempty"`
+	ParentID int    `json:"parent_id,omitempty"`
+	Name     string `json:"name"`
+	Content  string `json:"content"`
+	TTL      int    `json:"ttl,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+	Type     string `json:"type,omitempty"`
+	// Regions are the regions the record is served from, only sent
+	// with listings as records are always created for all of them.
+	Regions []string `json:"regions,omitempty"`
+	System  bool     `json:"system_record,omitempty"`
+	Created string   `json:"created_at,omitempty"`
+	Updated string   `json:"updated_at,omitempty"`
+}
+
+func toV2(rec Record) recordV2 {
+	return recordV2{
+		Name:     rec.Record.Name,
+		Content:  rec.Record.Content,
+		TTL:      rec.Record.TTL,
+		Priority: rec.Record.Priority,
+		Type:     rec.Record.Type,
+	}
+}
+
+func fromV2(r recordV2) Record {
+	rec := NewRecord(r.Name, r.Type, r.Content, r.TTL)
+	rec.Record.ID = r.ID
+	rec.Record.ParentID = r.ParentID
+	rec.Record.Priority = r.Priority
+	rec.Record.Created = r.Created
+	rec.Record.Updated = r.Updated
+	rec.Record.SystemRecord = r.System
+	return rec
+}
+
+// DiscoverAccount asks the v2 API which account the token belongs to. A
+// user token with access to several accounts can't be resolved; the
+// account has to be given explicitly then.
+func (c *Client) DiscoverAccount(ctx context.Context) (string, error) {
+	var whoami struct {
+		Data struct {
+			Account *struct {
+				ID int `json:"id"`
+			} `json:"account"`
+		} `json:"data"`
+	}
+	if err := c.getJSON(ctx, c.url("/v2/whoami"), &whoami); err != nil {
+		return "", err
+	}
+	if whoami.Data.Account != nil {
+		return strconv.Itoa(whoami.Data.Account.ID), nil
+	}
+
+	// User tokens aren't tied to an account, but may only have one
+	var accounts struct {
+		Data []struct {
+			ID    int    `json:"id"`
+			Email string `json:"email"`
+		} `json:"data"`
+	}
+	if err := c.getJSON(ctx, c.url("/v2/accounts"), &accounts); err != nil {
+		return "", err
+	}
+	switch len(accounts.Data) {
+	case 0:
+		return "", fmt.Errorf("Token has access to no account")
+	case 1:
+		return strconv.Itoa(accounts.Data[0].ID), nil
+	}
+	ids := ""
+	for i, a := range accounts.Data {
+		if i > 0 {
+			ids += ", "
+		}
+		ids += fmt.Sprintf("%d (%s)", a.ID, a.Email)
+	}
+	return "", fmt.Errorf("Token has access to several accounts, pick one of %s", ids)
+}
+
+func (c *Client) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return apiError("Request failed", resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// recordState is what a record holds before or after a change.
+type recordState struct {
+	Content  string `json:"content"`
+	TTL      int    `json:"ttl"`
+	Priority int    `json:"prio,omitempty"`
+}
+
+// dryRunEntry is a change of the -dry-run output. Before is nil for
+// records that would be created, After for ones that would be deleted.
+type dryRunEntry struct {
+	Action string       `json:"action"`
+	Domain string       `json:"domain"`
+	Name   string       `json:"name"`
+	Type   string       `json:"type"`
+	ID     int          `json:"id,omitempty"`
+	Before *recordState `json:"before"`
+	After  *recordState `json:"after"`
+}
+
+// printPlan prints the changes an update would make, showing each record
+// before and after, without making them.
+func printPlan(ctx context.Context) error {
+	domains, plans, err := planAll(ctx)
+	if err != nil {
+		return err
+	}
+
+	entries := []dryRunEntry{}
+	for _, domain := range domains {
+		for _, c := range plans[domain] {
+			if c.Action == actionNone {
+				continue
+			}
+			e := dryRunEntry{
+				Action: c.Action,
+				Domain: domain,
+				Name:   c.New.Name,
+				Type:   c.New.Type,
+				ID:     c.Old.Record.ID,
+			}
+			if c.Action != actionCreate {
+				e.Before = &recordState{c.Old.Record.Content, c.Old.Record.TTL, c.Old.Record.Priority}
+			}
+			if c.Action == actionDelete {
+				e.Name, e.Type = c.Old.Record.Name, c.Old.Record.Type
+			} else {
+				e.After = &recordState{c.New.Content, clampTTL(c.New.TTL), c.New.Priority}
+				if c.New.TTL == 0 && e.Before != nil {
+					// The TTL isn't managed and stays as it is
+					e.After.TTL = e.Before.TTL
+				}
+			}
+			entries = append(entries, e)
+		}
+	}
+
+	if *outputFormat == "table" {
+		if len(entries) == 0 {
+			fmt.Println("No changes")
+		}
+		for _, e := range entries {
+			fmt.Printf("%s %s record %s", e.Action, e.Type, recordFQDN(e.Name, e.Domain))
+			if e.ID != 0 {
+				fmt.Printf(" (ID %d)", e.ID)
+			}
+			fmt.Println()
+			if e.Before != nil {
+				fmt.Printf("  - %s\n", e.Before)
+			}
+			if e.After != nil {
+				fmt.Printf("  + %s\n", e.After)
+			}
+		}
+		return nil
+	}
+
+	var rows [][]string
+	for _, e := range entries {
+		row := []string{e.Action, e.Domain, e.Name, e.Type, "", "", "", ""}
+		if e.Before != nil {
+			row[4], row[5] = e.Before.Content, strconv.Itoa(e.Before.TTL)
+		}
+		if e.After != nil {
+			row[6], row[7] = e.After.Content, strconv.Itoa(e.After.TTL)
+		}
+		rows = append(rows, row)
+	}
+	return writeOutput(entries, []string{"action", "domain", "name", "type", "content", "ttl", "new_content", "new_ttl"}, rows)
+}
+
+func (s *recordState) String() string {
+	str := fmt.Sprintf("%s  ttl %d", s.Content, s.TTL)
+	if s.Priority != 0 {
+		str += fmt.Sprintf("  prio %d", s.Priority)
+	}
+	return str
+}
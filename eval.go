@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// evalResult is what -eval and -output-record-id print after the update of
+// -once.
+var evalResult struct {
+	mu      sync.Mutex
+	ip      string
+	changed bool
+	ids     []int
+}
+
+// noteIP records the external IP the update used, for -eval.
+func noteIP(ip string) {
+	evalResult.mu.Lock()
+	defer evalResult.mu.Unlock()
+	evalResult.ip = ip
+}
+
+// noteWritten records that record id was written with ip, which was oldIP
+// before, for -eval.
+func noteWritten(id int, oldIP, ip string) {
+	evalResult.mu.Lock()
+	defer evalResult.mu.Unlock()
+	evalResult.ids = append(evalResult.ids, id)
+	if oldIP != ip {
+		evalResult.changed = true
+	}
+}
+
+// printEval prints the result of the update as shell variable assignments:
+//
+//	DNSIMPLE_IP         the external IP, empty if none was used
+//	DNSIMPLE_CHANGED    true if a record was created or got a new IP
+//	DNSIMPLE_RECORD_ID  the IDs of the records written, comma separated
+//
+// They are printed on one line, so eval "$(dnsimple-updater -once -eval)"
+// sets them.
+func printEval() {
+	evalResult.mu.Lock()
+	defer evalResult.mu.Unlock()
+	ids := make([]string, len(evalResult.ids))
+	for i, id := range evalResult.ids {
+		ids[i] = strconv.Itoa(id)
+	}
+	fmt.Printf("DNSIMPLE_IP=%s DNSIMPLE_CHANGED=%t DNSIMPLE_RECORD_ID=%s\n",
+		shellQuote(evalResult.ip), evalResult.changed, shellQuote(strings.Join(ids, ",")))
+}
+
+// printRecordIDs prints the IDs of the records written, one per line and
+// nothing else, so a script can capture them. Nothing is printed if no
+// record had to be written.
+func printRecordIDs() {
+	evalResult.mu.Lock()
+	defer evalResult.mu.Unlock()
+	for _, id := range evalResult.ids {
+		fmt.Println(id)
+	}
+}
+
+// shellQuote returns s as a single shell word, quoting it if needed.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "0123456789abcdefABCDEF.:,") == "" {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
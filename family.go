@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// familyProbeTimeout limits how long -detect-family auto waits for the IP
+// providers of one family.
+const familyProbeTimeout = 10 * time.Second
+
+// probedFamilies holds the IP families -detect-family auto found working,
+// nil until they are probed.
+var probedFamilies []int
+
+// familyState is what the update keeps between runs for the records of
+// one type when -detect-family manages several.
+type familyState struct {
+	cache   *RecordCache
+	created *Record
+}
+
+// familyStates holds the state of each record type -detect-family
+// manages.
+var familyStates = map[string]*familyState{}
+
+// typeOfFamily returns the record type holding addresses of family.
+func typeOfFamily(family int) string {
+	if family == 6 {
+		return "AAAA"
+	}
+	return "A"
+}
+
+// checkDetectFamily validates -detect-family against the other flags.
+func checkDetectFamily() error {
+	switch *detectFamily {
+	case "":
+		return nil
+	case "auto", "4", "6", "both":
+	default:
+		return fmt.Errorf("Invalid -detect-family %q, expected auto, 4, 6 or both", *detectFamily)
+	}
+	switch {
+	case *specFile != "" || *contentFlag != "" || *filterExpr != "":
+		return fmt.Errorf("-detect-family can't be used with -spec, -content or -filter")
+	case isSet("type"):
+		return fmt.Errorf("-detect-family picks the record types, -type can't be set with it")
+	case *seedIP != "":
+		return fmt.Errorf("-detect-family can't be used with -seed-ip")
+	}
+	return nil
+}
+
+// detectedFamilies returns the IP families whose records to manage, as
+// given by -detect-family or, with auto, found by asking the IP providers
+// for an address of each. The probe runs once and again after a config
+// reload. Finding neither family is an error, and the probe is repeated
+// on the next update then.
+func detectedFamilies(ctx context.Context) ([]int, error) {
+	switch *detectFamily {
+	case "4":
+		return []int{4}, nil
+	case "6":
+		return []int{6}, nil
+	case "both":
+		return []int{4, 6}, nil
+	}
+	if probedFamilies != nil {
+		return probedFamilies, nil
+	}
+
+	var families []int
+	for _, family := range []int{4, 6} {
+		if probeFamily(ctx, family) {
+			families = append(families, family)
+			logInfo("Detected IPv%d connectivity, managing the %s records of %s", family, typeOfFamily(family), fqdn())
+		} else {
+			logInfo("No IPv%d connectivity, leaving the %s records of %s alone", family, typeOfFamily(family), fqdn())
+		}
+	}
+	if len(families) == 0 {
+		return nil, fmt.Errorf("Found neither working IPv4 nor IPv6 connectivity")
+	}
+	probedFamilies = families
+	return families, nil
+}
+
+// probeFamily reports whether the IP providers return an address of
+// family, which shows the host can reach the internet over it.
+func probeFamily(ctx context.Context, family int) bool {
+	ctx, cancel := context.WithTimeout(ctx, familyProbeTimeout)
+	defer cancel()
+	ip, err := lookupIP(ctx, family)
+	if err != nil {
+		logDebug("No IPv%d connectivity: %s", family, err)
+		return false
+	}
+	parsed := net.ParseIP(ip)
+	return parsed != nil && (parsed.To4() != nil) == (family == 4)
+}
+
+// familyRecords returns the records -detect-family manages, for planning
+// them as a spec would.
+func familyRecords(ctx context.Context) ([]SpecRecord, error) {
+	families, err := detectedFamilies(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var recs []SpecRecord
+	for _, family := range families {
+		recs = append(recs, SpecRecord{Name: *entryName, Type: typeOfFamily(family), Content: autoContent, TTL: *recordTTL})
+	}
+	return recs, nil
+}
+
+// updateFamilies updates the records of each family -detect-family
+// manages in turn, as if -type was set to their type. A failure of one
+// doesn't keep the others from being updated.
+func updateFamilies(ctx context.Context) error {
+	families, err := detectedFamilies(ctx)
+	if err != nil {
+		return err
+	}
+	var errs []string
+	for _, family := range families {
+		if err := withRecordType(typeOfFamily(family), func() error { return updateSingle(ctx) }); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// withRecordType runs fn with -type set to typ, along with the cached
+// records and created record of that type.
+func withRecordType(typ string, fn func() error) error {
+	st, ok := familyStates[typ]
+	if !ok {
+		st = &familyState{cache: &RecordCache{}}
+		familyStates[typ] = st
+	}
+	savedType, savedCache, savedCreated := *recordType, matchCache, createdRecord
+	*recordType, matchCache, createdRecord = typ, st.cache, st.created
+	defer func() {
+		st.created = createdRecord
+		*recordType, matchCache, createdRecord = savedType, savedCache, savedCreated
+	}()
+	return fn()
+}
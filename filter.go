@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// RecordFilter reports whether a record is one to manage.
+type RecordFilter func(Record) bool
+
+// filterFields are the fields of a record -filter can compare.
+var filterFields = map[string]func(Record) string{
+	"name":    func(r Record) string { return r.Record.Name },
+	"type":    func(r Record) string { return r.Record.Type },
+	"content": func(r Record) string { return r.Record.Content },
+	"ttl":     func(r Record) string { return strconv.Itoa(r.Record.TTL) },
+	"prio":    func(r Record) string { return strconv.Itoa(r.Record.Priority) },
+	"id":      func(r Record) string { return strconv.Itoa(r.Record.ID) },
+}
+
+// parseFilter parses a -filter expression such as
+//
+//	name==home && type==A && content!=1.2.3.4
+//
+// Comparisons of a field with == or != can be combined with && and ||,
+// where && binds tighter, and grouped with parentheses. Values may be
+// quoted with double quotes. @ as a name stands for the apex.
+func parseFilter(s string) (RecordFilter, error) {
+	tokens, err := tokenizeFilter(s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid -filter: %s", err)
+	}
+	p := &filterParser{tokens: tokens}
+	f, err := p.or()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid -filter: %s", err)
+	}
+	return f, nil
+}
+
+type filterToken struct {
+	text string
+	// quoted values are never taken for operators
+	quoted bool
+}
+
+func tokenizeFilter(s string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, filterToken{text: string(c)})
+			i++
+		case strings.HasPrefix(s[i:], "==") || strings.HasPrefix(s[i:], "!=") ||
+			strings.HasPrefix(s[i:], "&&") || strings.HasPrefix(s[i:], "||"):
+			tokens = append(tokens, filterToken{text: s[i : i+2]})
+			i += 2
+		case c == '"':
+			end := strings.IndexByte(s[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			tokens = append(tokens, filterToken{text: s[i+1 : i+1+end], quoted: true})
+			i += end + 2
+		default:
+			start := i
+			for i < len(s) && !strings.ContainsRune(" \t()=!&|\"", rune(s[i])) {
+				i++
+			}
+			if i == start {
+				return nil, fmt.Errorf("unexpected %q", s[i:])
+			}
+			tokens = append(tokens, filterToken{text: s[start:i]})
+		}
+	}
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+// accept consumes the next token if it is the operator op.
+func (p *filterParser) accept(op string) bool {
+	if p.pos < len(p.tokens) && !p.tokens[p.pos].quoted && p.tokens[p.pos].text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) next() (filterToken, error) {
+	if p.pos >= len(p.tokens) {
+		return filterToken{}, fmt.Errorf("unexpected end")
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *filterParser) or() (RecordFilter, error) {
+	left, err := p.and()
+	for err == nil && p.accept("||") {
+		var right RecordFilter
+		if right, err = p.and(); err == nil {
+			l := left
+			left = func(r Record) bool { return l(r) || right(r) }
+		}
+	}
+	return left, err
+}
+
+func (p *filterParser) and() (RecordFilter, error) {
+	left, err := p.comparison()
+	for err == nil && p.accept("&&") {
+		var right RecordFilter
+		if right, err = p.comparison(); err == nil {
+			l := left
+			left = func(r Record) bool { return l(r) && right(r) }
+		}
+	}
+	return left, err
+}
+
+func (p *filterParser) comparison() (RecordFilter, error) {
+	if p.accept("(") {
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("missing )")
+		}
+		return f, nil
+	}
+
+	field, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	get, ok := filterFields[strings.ToLower(field.text)]
+	if field.quoted || !ok {
+		return nil, fmt.Errorf("unknown field %q", field.text)
+	}
+	equal := true
+	switch {
+	case p.accept("=="):
+	case p.accept("!="):
+		equal = false
+	default:
+		return nil, fmt.Errorf("expected == or != after %s", field.text)
+	}
+	value, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if !value.quoted && !isFilterValue(value.text) {
+		return nil, fmt.Errorf("expected a value after %s, got %q", field.text, value.text)
+	}
+	want := value.text
+	name := strings.ToLower(field.text)
+	if name == "name" && want == "@" {
+		want = ""
+	}
+	return func(r Record) bool {
+		got := get(r)
+		if name == "type" {
+			return strings.EqualFold(got, want) == equal
+		}
+		return (got == want) == equal
+	}, nil
+}
+
+// isFilterValue reports whether an unquoted token can be a value rather
+// than an operator or parenthesis.
+func isFilterValue(s string) bool {
+	return strings.IndexFunc(s, func(r rune) bool {
+		return !unicode.IsPrint(r) || strings.ContainsRune("()=!&|", r)
+	}) < 0 && s != ""
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Health remembers the outcome of the latest update and, with -canary,
+// of the latest canary check for /healthz.
+type Health struct {
+	mu         sync.Mutex
+	time       time.Time
+	err        error
+	canaryTime time.Time
+	canaryErr  error
+}
+
+// Set records the outcome of an update.
+func (h *Health) Set(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.time = time.Now()
+	h.err = err
+}
+
+// SetCanary records the outcome of a canary check.
+func (h *Health) SetCanary(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.canaryTime = time.Now()
+	h.canaryErr = err
+}
+
+// ServeHTTP answers 200 if the latest update succeeded and 503 if it
+// failed or there was none yet. A failed canary check also answers 503.
+func (h *Health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain")
+	switch {
+	case h.time.IsZero():
+		w.WriteHeader(503)
+		fmt.Fprintln(w, "No update yet")
+	case h.err != nil:
+		w.WriteHeader(503)
+		fmt.Fprintf(w, "Update at %s failed: %s\n", h.time.Format(time.RFC3339), h.err)
+	case h.canaryErr != nil:
+		w.WriteHeader(503)
+		fmt.Fprintf(w, "Canary check at %s failed: %s\n", h.canaryTime.Format(time.RFC3339), h.canaryErr)
+	default:
+		fmt.Fprintf(w, "Update at %s succeeded\n", h.time.Format(time.RFC3339))
+		if !h.canaryTime.IsZero() {
+			fmt.Fprintf(w, "Canary check at %s succeeded\n", h.canaryTime.Format(time.RFC3339))
+		}
+	}
+}
+
+// health is served at /healthz.
+var health = &Health{}
+
+// healthcheck asks the instance listening on -listen whether it is
+// healthy.
+func healthcheck() error {
+	if *listenAddr == "" {
+		return fmt.Errorf("healthcheck needs -listen to find the running instance")
+	}
+	host, port, err := net.SplitHostPort(*listenAddr)
+	if err != nil {
+		return err
+	}
+	// An instance listening on all addresses can be reached locally
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+
+	c := &http.Client{Timeout: 5 * time.Second}
+	resp, err := c.Get(fmt.Sprintf("http://%s/healthz", net.JoinHostPort(host, port)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	msg := strings.TrimSpace(string(body))
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%s", msg)
+	}
+	fmt.Println(msg)
+	return nil
+}
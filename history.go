@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HistoryEntry describes the outcome of a single create or update.
+type HistoryEntry struct {
+	Time   time.Time `json:"time"`
+	OldIP  string    `json:"old_ip,omitempty"`
+	NewIP  string    `json:"new_ip"`
+	Result string    `json:"result"`
+}
+
+// History is a fixed-size ring buffer of the most recent updates.
+type History struct {
+	mu      sync.Mutex
+	entries []HistoryEntry
+	next    int
+	full    bool
+}
+
+func NewHistory(size int) *History {
+	if size < 1 {
+		size = 1
+	}
+	return &History{entries: make([]HistoryEntry, size)}
+}
+
+// Add records e, overwriting the oldest entry if the buffer is full.
+func (h *History) Add(e HistoryEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries[h.next] = e
+	h.next = (h.next + 1) % len(h.entries)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Entries returns the recorded entries, newest first.
+func (h *History) Entries() []HistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := h.next
+	if h.full {
+		n = len(h.entries)
+	}
+	r := make([]HistoryEntry, 0, n)
+	for i := 1; i <= n; i++ {
+		r = append(r, h.entries[(h.next-i+len(h.entries))%len(h.entries)])
+	}
+	return r
+}
+
+func (h *History) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.Entries())
+}
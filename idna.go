@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// idnaProfile converts names the way idna.Lookup does, with the UTS #46
+// mapping and normalization and the bidi and joiner rules, except that
+// the STD3 rules are off: they refuse the underscores of _acme-challenge
+// and SRV names as well as wildcards.
+var idnaProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.StrictDomainName(false))
+
+// toASCII converts an internationalized domain name to the ASCII form
+// used in DNS, encoding every non-ASCII label with punycode.
+func toASCII(name string) (string, error) {
+	ascii, err := idnaProfile.ToASCII(name)
+	if err != nil {
+		return "", fmt.Errorf("Invalid name %q: %s", name, err)
+	}
+	for _, l := range strings.Split(ascii, ".") {
+		if len(l) > 63 {
+			return "", fmt.Errorf("Label %q of %q is too long once encoded", l, name)
+		}
+	}
+	return ascii, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestToASCII(t *testing.T) {
+	// Distinct characters, as punycode encodes repeated ones in little space
+	var long []rune
+	for i := 0; i < 30; i++ {
+		long = append(long, rune(0x4e00+i*97))
+	}
+	tests := []struct {
+		name, want string
+		ok         bool
+	}{
+		{"", "", true},
+		{"home", "home", true},
+		{"Home.Example.COM", "home.example.com", true},
+		{"bücher.example", "xn--bcher-kva.example", true},
+		{"BÜCHER.example", "xn--bcher-kva.example", true},
+		{"xn--bcher-kva.example", "xn--bcher-kva.example", true},
+		{"XN--BCHER-KVA.example", "xn--bcher-kva.example", true},
+		{"münchen.bücher.example", "xn--mnchen-3ya.xn--bcher-kva.example", true},
+		{"例え.テスト", "xn--r8jz45g.xn--zckzah", true},
+		{"☃.example", "xn--n3h.example", true},
+		{"_acme-challenge.bücher", "_acme-challenge.xn--bcher-kva", true},
+		{strings.Repeat("a", 63) + ".example", strings.Repeat("a", 63) + ".example", true},
+		{strings.Repeat("a", 64) + ".example", "", false},
+		{string(long) + ".example", "", false},
+		// Full-width forms and separators are mapped
+		{"ｂüｃｈｅｒ。example", "xn--bcher-kva.example", true},
+		// Decomposed input is normalized to NFC first
+		{"bu\u0308cher.example", "xn--bcher-kva.example", true},
+		{"ß.example", "xn--zca.example", true},
+		{"*.bücher.example", "*.xn--bcher-kva.example", true},
+		{"_sip._tcp", "_sip._tcp", true},
+		{"@", "@", true},
+		{"example.com.", "example.com.", true},
+		{"-home.example", "", false},
+		{"xn--invalid-.example", "", false},
+		{"xn--a.example", "", false},
+		// Right-to-left labels can't start with a left-to-right character
+		{"aא.example", "", false},
+	}
+	for _, test := range tests {
+		got, err := toASCII(test.name)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("toASCII(%q) = %q, %v; expected %q", test.name, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/syslog"
+	"os"
+	"strings"
+)
+
+// Log levels, in increasing order of severity.
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = map[string]int{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+// minLevel is set from -log-level. Messages below it are dropped.
+var minLevel = levelInfo
+
+// parseLogLevel returns the level of a -log-level value.
+func parseLogLevel(name string) (int, error) {
+	l, ok := levelNames[name]
+	if !ok {
+		return 0, fmt.Errorf("Invalid log level %q", name)
+	}
+	return l, nil
+}
+
+const (
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorReset  = "\x1b[0m"
+)
+
+// useColor is set from -color and decides whether the log helpers below
+// wrap their message in ANSI color codes.
+var useColor bool
+
+// parseColor interprets a -color value of auto, always or never.
+func parseColor(mode string) (bool, error) {
+	switch mode {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto":
+		fi, err := os.Stderr.Stat()
+		return err == nil && fi.Mode()&os.ModeCharDevice != 0, nil
+	}
+	return false, fmt.Errorf("Invalid color mode %q", mode)
+}
+
+// syslogWriter is set from -syslog and receives every logged message.
+// With syslogOnly, nothing is written to stderr anymore.
+var (
+	syslogWriter *syslog.Writer
+	syslogOnly   bool
+	syslogConfig string
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"user":   syslog.LOG_USER,
+	"daemon": syslog.LOG_DAEMON,
+	"local0": syslog.LOG_LOCAL0,
+	"local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6,
+	"local7": syslog.LOG_LOCAL7,
+}
+
+// setupSyslog interprets a -syslog value of off, also or only and
+// connects to the system logger with the given facility and tag. An
+// existing connection is kept if nothing changed.
+func setupSyslog(mode, facility, tag string) error {
+	prio, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return fmt.Errorf("Invalid syslog facility %q", facility)
+	}
+	switch mode {
+	case "off", "also", "only":
+	default:
+		return fmt.Errorf("Invalid syslog mode %q", mode)
+	}
+
+	config := strings.Join([]string{mode, facility, tag}, " ")
+	if config == syslogConfig {
+		return nil
+	}
+	var w *syslog.Writer
+	if mode != "off" {
+		var err error
+		if w, err = syslog.New(prio|syslog.LOG_INFO, tag); err != nil {
+			return fmt.Errorf("Could not connect to syslog: %s", err)
+		}
+	}
+	if syslogWriter != nil {
+		syslogWriter.Close()
+	}
+	syslogWriter, syslogOnly, syslogConfig = w, mode == "only", config
+	return nil
+}
+
+func logf(level int, color, format string, v ...interface{}) {
+	if level < minLevel {
+		return
+	}
+	output(level, color, fmt.Sprintf(format, v...))
+}
+
+// output writes msg to syslog with the priority of level and to stderr,
+// whatever -log-level is.
+func output(level int, color, msg string) {
+	if syslogWriter != nil {
+		switch level {
+		case levelDebug:
+			syslogWriter.Debug(msg)
+		case levelInfo:
+			syslogWriter.Info(msg)
+		case levelWarn:
+			syslogWriter.Warning(msg)
+		default:
+			syslogWriter.Err(msg)
+		}
+		if syslogOnly {
+			return
+		}
+	}
+	if useColor && color != "" {
+		msg = color + msg + colorReset
+	}
+	log.Print(msg)
+}
+
+func logDebug(format string, v ...interface{}) {
+	logf(levelDebug, "", format, v...)
+}
+
+func logInfo(format string, v ...interface{}) {
+	logf(levelInfo, "", format, v...)
+}
+
+func logWarn(format string, v ...interface{}) {
+	logf(levelWarn, colorYellow, format, v...)
+}
+
+// logSuccess logs a record that was successfully changed.
+func logSuccess(format string, v ...interface{}) {
+	logf(levelInfo, colorGreen, format, v...)
+}
+
+// Reasons for not making an update, as logged by logSkip and counted in
+// dnsimple_skip_total.
+const (
+	skipUnchanged    = "unchanged"
+	skipPrivateIP    = "private_ip"
+	skipNotAccepted  = "not_accepted"
+	skipThreshold    = "threshold"
+	skipMultiple     = "multiple_records"
+	skipSystemRecord = "system_record"
+	skipConflict     = "conflict"
+	skipDeclined     = "declined"
+	skipDryRun       = "dry_run"
+)
+
+// logSkip logs an update that was deliberately not made, followed by the
+// reason, and counts it. Records that are up to date are only logged at
+// debug level, and skips the user asked for at info level.
+func logSkip(reason, format string, v ...interface{}) {
+	skips.Inc(reason)
+	level, color := levelWarn, colorYellow
+	switch reason {
+	case skipUnchanged:
+		level, color = levelDebug, ""
+	case skipDryRun, skipDeclined:
+		level, color = levelInfo, ""
+	}
+	logf(level, color, format+" (skip reason: %s)", append(v, reason)...)
+}
+
+// logError logs a failed update.
+func logError(format string, v ...interface{}) {
+	logf(levelError, colorRed, format, v...)
+}
@@ -1,38 +1,210 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
 	"time"
+
+	"github.com/surma-dump/dnsimple-updater/dnsimple"
+	"golang.org/x/time/rate"
 )
 
 var (
 	updateFrequency = flag.Duration("f", 5*time.Minute, "Time between updates")
+	timeoutBudget   = flag.Duration("timeout-budget", time.Minute, "Time allowed for a whole update, from the IP lookup to the last API request (0 for no limit)")
+	cycleDeadline   = flag.Duration("cycle-deadline", 0, "Time after which an update is abandoned so the next one starts on schedule (defaults to -f)")
+	errorFrequency  = flag.Duration("interval-on-error", 0, "Time until the next update after a failed one (defaults to -f)")
 	apiServer       = flag.String("s", "api.dnsimple.com", "DNSimple API endpoint")
-	domainToken     = flag.String("t", "", "Value for X-DNSimple-Domain-Token header")
+	readServer      = flag.String("read-server", "", "API endpoint to list records and domains from instead of -s, such as a caching replica (writes always go to -s)")
+	domainToken     = flag.String("t", "", "API token: the domain token for v1, an account or user token for v2")
+	tokenFile       = flag.String("token-file", "", "File to read the API token from instead of -t. It is read again when the API rejects the token, in case it was rotated")
 	domainName      = flag.String("d", "", "Domain the entry is for")
-	entryName       = flag.String("n", "", "Name of the entry")
+	entryName       = flag.String("n", "", "Name of the entry (empty or @ for the domain apex)")
+	nameTemplate    = flag.String("n-template", "", "Template for the name of the entry, e.g. {{.ShortHostname}}-vpn or {{.Env.SITE}} (instead of -n)")
+	recordType      = flag.String("type", "A", "Type of the entry (see list-types)")
+	detectFamily    = flag.String("detect-family", "", "Manage A and AAAA records by the IP families that work: auto to probe them at startup, or 4, 6 or both to choose (replaces -type)")
+	recordTTL       = flag.Int("ttl", 5, "TTL of created records. Updates keep the TTL of the existing record unless this is set")
+	ipURL           = flag.String("ip-url", "https://jsonip.com", "Service answering with a JSON object holding the external IP")
+	ipURL4          = flag.String("ip-url4", "", "Service to ask for the external IPv4 address (defaults to -ip-url)")
+	ipURL6          = flag.String("ip-url6", "", "Service to ask for the external IPv6 address (defaults to -ip-url)")
+	waitPropagation = flag.Duration("wait-propagation", 0, "After an update, wait up to this long for the authoritative name servers to serve the changes, failing the update otherwise (0 to not wait)")
+	waitInterval    = flag.Duration("wait-propagation-interval", 5*time.Second, "Time between checks of the name servers for -wait-propagation")
+	compareWithDNS  = flag.Bool("compare-with-dns", false, "Look up changed records in DNS after each update and log whether the new value is live yet")
+	compareResolver = flag.String("compare-resolver", "", "DNS server to ask for -compare-with-dns, as host or host:port (defaults to the system resolver)")
+	ipServerName    = flag.String("ip-servername", "", "Name to send as TLS server name to the IP provider and to verify its certificate against")
+	allowInsecureIP = flag.Bool("allow-insecure-ip", false, "Allow looking up the external IP over plain HTTP")
+	ipHeader        = flag.String("ip-header", "", "Take the external IP from this header of the provider's response, such as X-Forwarded-For")
+	trustedProxies  = flag.String("trusted-proxies", "", "Comma separated CIDRs of proxies to skip in -ip-header")
+	ipProviders     = flag.String("ip-providers", "", "Comma separated IP providers to try in order: json:URL, text:URL, dns:NAME@SERVER, iface:NAME or file:PATH (defaults to -ip-url)")
+	seedIP          = flag.String("seed-ip", "", "IP to create the record with on the first update if it doesn't exist yet, before looking up the external IP")
+	forceIP         = flag.String("force-ip", "", "Use this as the external IP instead of looking it up (for testing)")
+	ipFile          = flag.String("ip-file", "", "Read the external IP from this file instead of looking it up")
+	stateFile       = flag.String("state-file", "", "File to remember the last detected external IP in across restarts")
+	staleIPGrace    = flag.Duration("stale-ip-grace", 0, "When the IP lookup fails, keep publishing the last detected IP for up to this long after it was seen (0 to not)")
+	ipThreshold     = flag.Int("ip-change-threshold", 0, "Prefix length within which a new IPv4 address counts as unchanged from the one in the record, e.g. 24 (0 for exact matches only)")
+	ipThreshold6    = flag.Int("ip-change-threshold6", 0, "Like -ip-change-threshold, for IPv6 addresses, e.g. 64")
+	acceptCIDRs     = listFlag("accept-cidr", "CIDR the external IP must be within, or the update is skipped. Can be repeated or comma separated (any public address if unset)")
+	rejectPrivate   = flag.Bool("reject-private", true, "Refuse to publish private, loopback or otherwise reserved addresses")
+	maxIdleConns    = flag.Int("max-idle-conns", 4, "Idle connections kept open for reuse (0 closes connections after each request)")
+	idleTimeout     = flag.Duration("idle-timeout", 90*time.Second, "Time an idle connection is kept open")
+	useHTTP2        = flag.Bool("http2", true, "Use HTTP/2 where the server supports it")
+	connTrace       = flag.Bool("conntrace", false, "Log the timings of DNS lookup, connect, TLS handshake and first response byte of each API request")
+	listenAddr      = flag.String("listen", "", "Address to serve the status endpoints on (e.g. :8080)")
+	historySize     = flag.Int("history-size", 50, "Number of updates kept for /history")
+	allowMultiple   = flag.Bool("allow-multiple", false, "Update all matching records instead of skipping when there is more than one")
+	maxRecords      = flag.Int("max-records", 10, "Most records an update may create, update or delete; it fails without changing anything if it would touch more (0 for no limit)")
+	filterExpr      = flag.String("filter", "", "Expression picking the records to update instead of -n and -type, e.g. name==home && content!=1.2.3.4 (see README)")
+	colorMode       = flag.String("color", "never", "Colorize log output: auto, always or never")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "Time to wait for an update in progress when shutting down")
+	specFile        = flag.String("spec", "", "JSON file listing the records the zone should contain")
+	prune           = flag.Bool("prune", false, "With -spec, delete records of the managed types that are not in the spec")
+	updateMode      = flag.String("update-mode", "patch", "How existing records are changed: patch (update in place) or recreate (create a new record, then delete the old one)")
+	recordsPerPage  = flag.Int("per-page", dnsimple.MaxPerPage, "Records fetched per request when listing (1-100)")
+	configFile      = flag.String("config", "", "JSON file with flag values, keyed by flag name")
+	hupAction       = flag.String("hup", "update", "What SIGHUP does: update (run an update now) or reload (re-read -config)")
+	logLevel        = flag.String("log-level", "info", "Minimum level of logged messages: debug, info, warn or error")
+	syslogMode      = flag.String("syslog", "off", "Send log messages to the system logger: off, also (as well as stderr) or only")
+	syslogFacility  = flag.String("syslog-facility", "daemon", "Syslog facility: daemon, user or local0 to local7")
+	syslogTag       = flag.String("syslog-tag", "dnsimple-updater", "Tag of the messages sent to syslog")
+	minTTL          = flag.Int("min-ttl", 0, "Lowest TTL written to a record (0 for no limit)")
+	maxTTL          = flag.Int("max-ttl", 0, "Highest TTL written to a record (0 for no limit)")
+	pidFile         = flag.String("pidfile", "", "File to write the process ID to while running")
+	bindAddr        = flag.String("bind", "", "Local address to look up the external IP from")
+	bindAPI         = flag.Bool("bind-api", false, "Also send API requests from -bind")
+	summaryInterval = flag.Duration("summary-interval", 0, "Time between summary lines in the log, regardless of -log-level (0 to disable)")
+	recordCacheTTL  = flag.Duration("record-cache-ttl", 0, "Time the matching records are reused before listing them again (0 lists on every update)")
+	ipMapFlag       = flag.String("ip-map", "", "Comma separated from=to pairs replacing a detected IP before it is used")
+	contentFlag     = flag.String("content", "", "Comma separated contents -n should have, one record each (defaults to the external IP); "+autoContent+" stands for the external IP. TXT contents can be templates using {{.IP}}, {{.Hostname}} and {{.Now}}")
+	srvPriority     = flag.Int("srv-priority", 0, "Priority of the SRV record (0-65535)")
+	srvWeight       = flag.Int("srv-weight", 0, "Weight of the SRV record (0-65535)")
+	srvPort         = flag.Int("srv-port", 0, "Port of the SRV record (1-65535)")
+	srvTarget       = flag.String("srv-target", "", "Host name the SRV record points to")
+	followRedirects = flag.Bool("follow-redirects", true, "Follow redirects from the IP provider and the API")
+	maxRedirects    = flag.Int("max-redirects", 10, "Most redirects followed per request")
+	concurrency     = flag.Int("concurrency", 4, "Number of records that are listed or changed at the same time")
+	apiRate         = flag.Float64("rate", 0, "Most API requests per second (0 for no limit)")
+	apiBurst        = flag.Int("burst", 1, "API requests that may be sent at once without regard to -rate")
+	once            = flag.Bool("once", false, "Run a single update and exit, with status 1 if it failed")
+	evalOutput      = flag.Bool("eval", false, "With -once, print the outcome as DNSIMPLE_IP=... DNSIMPLE_CHANGED=... DNSIMPLE_RECORD_ID=... for the shell to eval")
+	outputID        = flag.Bool("output-record-id", false, "With -once, print nothing but the IDs of the records created or updated, one per line, if the update succeeded")
+	onceThenWatch   = flag.Bool("once-then-watch", false, "Exit unless the first update succeeds, before starting to update every -f")
+	onceRetries     = flag.Int("once-retries", 3, "Attempts at the first update with -once-then-watch")
+	retryDelay      = flag.Duration("retry-delay", time.Second, "Pause before the first retry of -once-then-watch and -egress-check, doubled for each further one (at least 500ms)")
+	outputFormat    = flag.String("output", "table", "Output of the list and diff commands and of -dry-run: table, json or csv")
+	dryRun          = flag.Bool("dry-run", false, "Print the changes each update would make, with every record before and after, instead of making them")
+	assumeYes       = flag.Bool("yes", false, "Don't ask before deleting records with the delete command, or before creating and deleting them with -interactive")
+	interactive     = flag.Bool("interactive", false, "Ask on the terminal before creating or deleting a record (not asked without a terminal)")
+	ipTimeout       = flag.Duration("ip-timeout", 0, "Time allowed for each IP provider to answer before the next one is asked (0 for no limit)")
+	ipRetries       = flag.Int("ip-retries", 2, "Times to ask an IP provider again when it answers with a status of -ip-retry-status")
+	ipRetryStatus   = flag.String("ip-retry-status", "429,500,502,503,504", "HTTP statuses of an IP provider worth asking it again for, as codes or ranges like 500-599 (others go on to the next provider)")
+	providerCool    = flag.Duration("provider-health", 0, "Time to ask an IP provider of -ip-providers last for after it failed, trying it in its turn again afterwards (0 to always ask in order)")
+	apiTimeout      = flag.Duration("api-timeout", 0, "Time allowed for the API requests of an update (0 for no limit)")
+	maxRecordAge    = flag.Duration("max-record-age", 0, "Rewrite up to date records last written longer ago than this (0 to never)")
+	egressCheck     = flag.Duration("egress-check", 0, "Time to wait at startup for the API to become reachable (0 to not wait)")
+	backendName     = flag.String("backend", "", "Envelope of the records the API sends and receives: dnsimple-v1 or dnsimple-v2 (defaults to the one of -api-version)")
+	strictJSON      = flag.Bool("strict-json", false, "Fail on fields of listed records that aren't known, to notice changes of the API")
+	apiVersion      = flag.Int("api-version", 1, "DNSimple API version to use (1 or 2)")
+	accountID       = flag.String("account", "", "Account ID for the v2 API (found from the token if unset)")
+	statsdAddr      = flag.String("statsd", "", "host:port of a StatsD server to send metrics to over UDP")
+	statsdPrefix    = flag.String("statsd-prefix", "", "Prefix for the names of metrics sent to StatsD")
+	webhookURL      = flag.String("webhook", "", "URL to post events such as changes of the external IP to as JSON")
+	webhookSecret   = flag.String("webhook-secret", "", "Secret to sign -webhook payloads with, sent as HMAC-SHA256 in the X-Signature header")
+	slackWebhook    = flag.String("slack-webhook", "", "Slack incoming webhook URL to post events to as messages")
+	notifyExec      = flag.String("notify-exec", "", "Shell command to run for each event, getting it as JSON on stdin and in DNSIMPLE_* variables")
+	publishURL      = flag.String("publish-url", "", "URL to also send the external IP to whenever it changes, e.g. a service discovery endpoint")
+	publishMethod   = flag.String("publish-method", "PUT", "HTTP method of the -publish-url request")
+	publishBody     = flag.String("publish-body", "{{.IP}}", "Template of the -publish-url request body, with the fields of the ip_changed event and .IP")
+	canaryName      = flag.String("canary", "", "Name of a TXT record of its own to write a rising count to and read back after each update, to notice dropped updates")
+	versionURL      = flag.String("version-check-url", "", "URL publishing the latest version, as plain text or {\"version\": ...}, to check for newer releases (off if empty)")
+	versionInterval = flag.Duration("version-check-interval", 24*time.Hour, "Time between checks for a newer version")
 	help            = flag.Bool("h", false, "Show this help")
 )
 
+// spec is the desired state of the zone when -spec is used.
+var spec *Spec
+
+// createdRecord is the record created by the previous update, if any. It
+// saves listing the records again on the update right after a create.
+var createdRecord *Record
+
+// seeded is set once the first update has considered -seed-ip.
+var seeded bool
+
+// summary collects the numbers for -summary-interval.
+var summary = NewSummary()
+
+// ipMap is parsed from -ip-map.
+var ipMap map[string]string
+
+// trustedNets is parsed from -trusted-proxies.
+var trustedNets []*net.IPNet
+
+// acceptNets is parsed from -accept-cidr.
+var acceptNets []*net.IPNet
+
+// recordFilter is parsed from -filter.
+var recordFilter RecordFilter
+
+// contents is parsed from -content.
+var contents []string
+
+// ipRetryCodes holds the statuses of -ip-retry-status.
+var ipRetryCodes map[int]bool
+
+// matchCache holds the records matching -n and -type for -record-cache-ttl.
+var matchCache = &RecordCache{}
+
+// updateHistory keeps track of recent updates for the /history endpoint.
+var updateHistory *History
+
+// client is shared by all API requests so connections can be reused.
+var client = http.DefaultClient
+
+// apiScheme is the scheme of all API requests. Only something like a
+// local stub server would use anything but https.
+var apiScheme = "https"
+
+// ipClients are used to look up the external IP, keyed by the IP family
+// they are restricted to (0 for either).
+var ipClients = map[int]*http.Client{}
+
+// backends are the record envelopes -backend accepts.
+var backends = map[string]dnsimple.Backend{
+	"dnsimple-v1": dnsimple.V1,
+	"dnsimple-v2": dnsimple.V2,
+}
+
+// recordTypes lists the record types that can be managed, mapped to a
+// short description of the content that is written.
+var recordTypes = map[string]string{
+	"A":     "External IPv4 address",
+	"AAAA":  "External IPv6 address",
+	"SRV":   "Service location from -srv-weight, -srv-port and -srv-target, or -content",
+	"ALIAS": "Host name given with -content, resolved by DNSimple (for the apex)",
+	"CNAME": "Host name given with -content",
+	"TXT":   "Text given with -content",
+}
+
 //go:generate gen
 // +gen slice:"Where"
-type Record struct {
-	Record struct {
-		ID       int    `json:"id,omitempty"`
-		Name     string `json:"name"`
-		TTL      int    `json:"ttl,omitempty"`
-		Created  string `json:"created_at,omitempty"`
-		Updated  string `json:"updated_at,omitempty"`
-		DomainID int    `json:"domain_id,omitempty"`
-		Content  string `json:"content"`
-		Type     string `json:"record_type"`
-	} `json:"record"`
-}
+type Record = dnsimple.Record
 
 func main() {
 	flag.Parse()
@@ -42,128 +214,1934 @@ func main() {
 		return
 	}
 
-	if *domainToken == "" || *domainName == "" || *entryName == "" {
-		log.Fatalf("-t, -d and -n must be set")
+	if flag.Arg(0) == "list-types" {
+		listTypes()
+		return
 	}
 
-	// Don't wait on the very first run
-	d := 0 * time.Second
-	for {
-		time.Sleep(d)
-		d = *updateFrequency
+	flag.Visit(func(f *flag.Flag) {
+		commandLine[f.Name] = true
+	})
+	if *configFile != "" {
+		if err := applyConfig(*configFile); err != nil {
+			log.Fatalf("%s", err)
+		}
+	}
+	if flag.Arg(0) == "healthcheck" {
+		if err := healthcheck(); err != nil {
+			fmt.Printf("Unhealthy: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.Arg(0) == "list-domains" {
+		// Only the token is needed to find out which domain to use
+		if err := loadTokenFile(); err != nil {
+			log.Fatalf("%s", err)
+		}
+		if *domainToken == "" {
+			log.Fatalf("-t or -token-file must be set")
+		}
+		setupClients()
+		if err := listDomains(context.Background()); err != nil {
+			log.Fatalf("%s", err)
+		}
+		return
+	}
+	if err := setup(); err != nil {
+		log.Fatalf("%s", err)
+	}
+	setupClients()
+	if *stateFile != "" {
+		if err := loadState(*stateFile); err != nil {
+			log.Fatalf("%s", err)
+		}
+	}
+	if *statsdAddr != "" {
+		s, err := NewStatsD(*statsdAddr, *statsdPrefix)
+		if err != nil {
+			log.Fatalf("Could not set up StatsD: %s", err)
+		}
+		statsd = s
+	}
 
-		ip, err := externalIP()
+	switch flag.Arg(0) {
+	case "":
+	case "check":
+		if !check() {
+			os.Exit(1)
+		}
+		return
+	case "list":
+		if err := list(context.Background()); err != nil {
+			log.Fatalf("%s", err)
+		}
+		return
+	case "delete":
+		if err := deleteEntry(context.Background()); err != nil {
+			log.Fatalf("%s", err)
+		}
+		return
+	case "present", "cleanup":
+		if spec != nil {
+			log.Fatalf("%s manages the challenge records of -n and can't be used with -spec", flag.Arg(0))
+		}
+		run := presentChallenge
+		if flag.Arg(0) == "cleanup" {
+			run = cleanupChallenge
+		}
+		if err := run(context.Background(), flag.Args()[1:]); err != nil {
+			log.Fatalf("%s", err)
+		}
+		return
+	case "diff":
+		drift, err := diff(context.Background())
 		if err != nil {
-			log.Printf("Could not obtain external IP: %s", err)
-			continue
+			logError("%s", err)
+			os.Exit(2)
 		}
-		log.Printf("External IP: %s", ip)
+		if drift {
+			os.Exit(1)
+		}
+		return
+	default:
+		log.Fatalf("Unknown command %q", flag.Arg(0))
+	}
+
+	updateHistory = NewHistory(*historySize)
 
-		recs, err := listRecords()
+	if *once {
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+		if *egressCheck > 0 {
+			waitForAPI(ctx, *egressCheck)
+		}
+		err := runOnce(ctx)
+		notifications.Wait()
+		if *evalOutput {
+			printEval()
+		}
 		if err != nil {
-			log.Printf("Could not list records: %s", err)
-			continue
+			logError("%s", err)
+			os.Exit(1)
+		}
+		if *outputID {
+			printRecordIDs()
 		}
+		return
+	}
 
-		aRecs := recs.Where(func(r Record) bool {
-			return r.Record.Name == *entryName
-		}).Where(func(r Record) bool {
-			return r.Record.Type == "A"
-		})
+	notify(Event{Kind: EventStartup})
+
+	// With -once-then-watch, the loop starts with a wait since the first
+	// update already happened here
+	var firstUpdate time.Duration
+	if *onceThenWatch {
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		if *egressCheck > 0 {
+			waitForAPI(ctx, *egressCheck)
+		}
+		err := syncOnce(ctx, *onceRetries)
+		health.Set(err)
+		cancel()
+		if err != nil {
+			log.Fatalf("First update failed: %s", err)
+		}
+		firstUpdate = *updateFrequency
+	}
+
+	// Keep the path in case a config reload changes the flag
+	pidPath := *pidFile
+	if pidPath != "" {
+		if err := ioutil.WriteFile(pidPath, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644); err != nil {
+			log.Fatalf("Could not write PID file: %s", err)
+		}
+		defer os.Remove(pidPath)
+	}
+
+	if *listenAddr != "" {
+		go serveHTTP()
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	// stop ends the loop after the current update, abort cancels the
+	// update itself once the shutdown timeout has passed.
+	stop, stopLoop := context.WithCancel(context.Background())
+	abort, abortUpdate := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		if *egressCheck > 0 && !*onceThenWatch {
+			waitForAPI(stop, *egressCheck)
+		}
+		updateLoop(stop, abort, hup, firstUpdate)
+		close(done)
+	}()
+	if *summaryInterval > 0 {
+		go logSummaries(summary, *summaryInterval, done)
+	}
+	if *versionURL != "" {
+		go checkVersions(*versionURL, *versionInterval, done)
+	}
+
+	logInfo("Received %s, shutting down", <-sigs)
+	stopLoop()
+	select {
+	case <-done:
+		notify(Event{Kind: EventShutdown})
+		notifications.Wait()
+		logInfo("Shutdown complete")
+	case <-time.After(*shutdownTimeout):
+		abortUpdate()
+		logInfo("Update still running after %s, forcing shutdown", *shutdownTimeout)
+		if pidPath != "" {
+			os.Remove(pidPath)
+		}
+		os.Exit(1)
+	}
+}
+
+// setupClients creates the HTTP clients for the API and the IP providers.
+func setupClients() {
+	client = newClient(*bindAddr, 0)
+	if !*bindAPI {
+		client = newClient("", 0)
+	}
+	client.CheckRedirect = redirectPolicy(nil)
+	if *connTrace {
+		client.Transport = &tracingTransport{client.Transport}
+	}
+	if *apiRate > 0 {
+		client.Transport = &limitedTransport{client.Transport, rate.NewLimiter(rate.Limit(*apiRate), *apiBurst)}
+	}
+	if *tokenFile != "" {
+		client.Transport = &tokenTransport{client.Transport}
+	}
+	for _, family := range []int{0, 4, 6} {
+		ipClients[family] = newClient(*bindAddr, family)
+		ipClients[family].CheckRedirect = redirectPolicy(checkProvider)
+		if *ipServerName != "" {
+			ipClients[family].Transport.(*http.Transport).TLSClientConfig = &tls.Config{ServerName: *ipServerName}
+		}
+	}
+}
+
+// settings is what setup derives from the flags for the updates to use.
+type settings struct {
+	spec         *Spec
+	ipMap        map[string]string
+	trustedNets  []*net.IPNet
+	acceptNets   []*net.IPNet
+	recordFilter RecordFilter
+	contents     []string
+	ipRetryCodes map[int]bool
+	notifier     Notifier
+	minLevel     int
+	useColor     bool
+}
+
+// apply puts s in place for the updates to come.
+func (s *settings) apply() {
+	spec = s.spec
+	ipMap = s.ipMap
+	trustedNets = s.trustedNets
+	acceptNets = s.acceptNets
+	recordFilter = s.recordFilter
+	contents = s.contents
+	ipRetryCodes = s.ipRetryCodes
+	notifier = s.notifier
+	minLevel = s.minLevel
+	useColor = s.useColor
+	setupWorkers(*concurrency)
+}
+
+// setup validates and normalizes the flags. It runs at startup and again
+// whenever the config file is reloaded. What it derives from the flags is
+// only put in place once all of them were found valid, so that a config
+// file that fails to reload leaves the old settings in use.
+func setup() error {
+	s := &settings{}
+	if err := loadTokenFile(); err != nil {
+		return err
+	}
+	domain, err := toASCII(*domainName)
+	if err != nil {
+		return err
+	}
+	*domainName = domain
+
+	if *specFile != "" {
+		sp, err := loadSpec(*specFile)
+		if err != nil {
+			return err
+		}
+		if err := sp.validate(); err != nil {
+			return err
+		}
+		s.spec = sp
+	} else if *domainToken == "" || *domainName == "" || !isSet("n") && *nameTemplate == "" && !isChallengeCommand() {
+		return fmt.Errorf("-t (or -token-file), -d and -n (or -spec) must be set")
+	}
+	if *nameTemplate != "" {
+		if isSet("n") {
+			return fmt.Errorf("-n and -n-template can't both be set")
+		}
+		name, err := renderName(*nameTemplate)
+		if err != nil {
+			return err
+		}
+		*entryName = name
+	}
+	name, err := toASCII(*entryName)
+	if err != nil {
+		return err
+	}
+	name, err = relativeName(name, *domainName)
+	if err != nil {
+		return err
+	}
+	*entryName = name
+	if s.useColor, err = parseColor(*colorMode); err != nil {
+		return err
+	}
+	if s.minLevel, err = parseLogLevel(*logLevel); err != nil {
+		return err
+	}
+	*recordType = strings.ToUpper(*recordType)
+	if _, ok := recordTypes[*recordType]; !ok {
+		return fmt.Errorf("Unsupported record type %q (see list-types)", *recordType)
+	}
+
+	if *versionURL != "" && *versionInterval <= 0 {
+		return fmt.Errorf("-version-check-interval must be positive")
+	}
+	if s.notifier, err = newNotifier(); err != nil {
+		return err
+	}
+	if *concurrency < 1 {
+		return fmt.Errorf("-concurrency must be at least 1")
+	}
+	if *ipThreshold < 0 || *ipThreshold > 32 {
+		return fmt.Errorf("-ip-change-threshold must be between 0 and 32")
+	}
+	if *ipThreshold6 < 0 || *ipThreshold6 > 128 {
+		return fmt.Errorf("-ip-change-threshold6 must be between 0 and 128")
+	}
+	if *ipRetries < 0 {
+		return fmt.Errorf("-ip-retries must not be negative")
+	}
+	if s.ipRetryCodes, err = parseStatusCodes(*ipRetryStatus); err != nil {
+		return err
+	}
+	if *providerCool < 0 {
+		return fmt.Errorf("-provider-health must not be negative")
+	}
+	if *maxRecords < 0 {
+		return fmt.Errorf("-max-records must not be negative")
+	}
+	if *canaryName != "" {
+		if *domainName == "" {
+			return fmt.Errorf("-canary needs -d")
+		}
+		canary, err := toASCII(*canaryName)
+		if err != nil {
+			return err
+		}
+		if canary, err = relativeName(canary, *domainName); err != nil {
+			return err
+		}
+		if s.spec == nil && canary == *entryName && *recordType == "TXT" {
+			return fmt.Errorf("-canary must not be the record being updated")
+		}
+		*canaryName = canary
+	}
+	if *recordTTL < 0 {
+		return fmt.Errorf("-ttl must not be negative")
+	}
+	if *recordsPerPage < 1 {
+		logWarn("-per-page must be at least 1, using 1")
+		*recordsPerPage = 1
+	}
+	if *recordsPerPage > dnsimple.MaxPerPage {
+		logWarn("-per-page must be at most %d, using %d", dnsimple.MaxPerPage, dnsimple.MaxPerPage)
+		*recordsPerPage = dnsimple.MaxPerPage
+	}
+	if *filterExpr != "" {
+		if s.spec != nil || *contentFlag != "" {
+			return fmt.Errorf("-filter can't be used with -spec or -content")
+		}
+		if s.recordFilter, err = parseFilter(*filterExpr); err != nil {
+			return err
+		}
+	}
+	if s.ipMap, err = parseIPMap(*ipMapFlag); err != nil {
+		return err
+	}
+	if s.acceptNets, err = parseCIDRs(acceptCIDRs.String()); err != nil {
+		return err
+	}
+	if s.trustedNets, err = parseCIDRs(*trustedProxies); err != nil {
+		return err
+	}
+	if s.contents, err = parseContents(*contentFlag, *recordType); err != nil {
+		return err
+	}
+	switch *recordType {
+	case "ALIAS", "CNAME":
+		if len(s.contents) != 1 {
+			return fmt.Errorf("-type %s needs the target host name as -content", *recordType)
+		}
+	case "TXT":
+		if len(s.contents) == 0 {
+			return fmt.Errorf("-type TXT needs -content")
+		}
+	}
+	if *recordType == "SRV" {
+		if err := checkUint16("-srv-priority", *srvPriority); err != nil {
+			return err
+		}
+		if len(s.contents) == 0 {
+			c := fmt.Sprintf("%d %d %s", *srvWeight, *srvPort, *srvTarget)
+			if err := checkSRV(c); err != nil {
+				return fmt.Errorf("Invalid SRV record, check -srv-weight, -srv-port and -srv-target: %s", err)
+			}
+			s.contents = []string{c}
+		}
+	}
+	if *ipProviders != "" {
+		if _, err := parseProviders(*ipProviders, 0); err != nil {
+			return err
+		}
+	}
+	for _, provider := range []string{*ipURL, *ipURL4, *ipURL6} {
+		if err := checkProvider(provider); err != nil {
+			return err
+		}
+	}
+	switch *outputFormat {
+	case "table", "json", "csv":
+	default:
+		return fmt.Errorf("Invalid output format %q", *outputFormat)
+	}
+	if err := checkDetectFamily(); err != nil {
+		return err
+	}
+	if *seedIP != "" {
+		ip := net.ParseIP(*seedIP)
+		switch {
+		case s.spec != nil || len(s.contents) > 0:
+			return fmt.Errorf("-seed-ip can't be combined with -spec or -content")
+		case ip == nil:
+			return fmt.Errorf("Invalid IP %q for -seed-ip", *seedIP)
+		case *recordType != "A" && *recordType != "AAAA":
+			return fmt.Errorf("-seed-ip only applies to A and AAAA records")
+		case (ip.To4() != nil) != (*recordType == "A"):
+			return fmt.Errorf("-seed-ip %s is not an address for an %s record", *seedIP, *recordType)
+		}
+		*seedIP = ip.String()
+	}
+	if *forceIP != "" {
+		ip := net.ParseIP(*forceIP)
+		if ip == nil {
+			return fmt.Errorf("Invalid IP %q for -force-ip", *forceIP)
+		}
+		*forceIP = ip.String()
+	}
+	if *apiVersion != 1 && *apiVersion != 2 {
+		return fmt.Errorf("Unsupported API version %d", *apiVersion)
+	}
+	if _, ok := backends[*backendName]; !ok && *backendName != "" {
+		return fmt.Errorf("Unknown backend %q", *backendName)
+	}
+	if *onceRetries < 1 {
+		return fmt.Errorf("-once-retries must be at least 1")
+	}
+	if *maxRedirects < 0 {
+		return fmt.Errorf("-max-redirects must not be negative")
+	}
+	if *apiRate < 0 {
+		return fmt.Errorf("-rate must not be negative")
+	}
+	if *retryDelay < minRetryDelay {
+		logWarn("-retry-delay must be at least %s, using %s", minRetryDelay, minRetryDelay)
+		*retryDelay = minRetryDelay
+	}
+	if *errorFrequency > 0 && *errorFrequency < minRetryDelay {
+		logWarn("-interval-on-error must be at least %s, using %s", minRetryDelay, minRetryDelay)
+		*errorFrequency = minRetryDelay
+	}
+	if *apiBurst < 1 {
+		return fmt.Errorf("-burst must be at least 1")
+	}
+	if *bindAddr != "" && net.ParseIP(*bindAddr) == nil {
+		return fmt.Errorf("Invalid bind address %q", *bindAddr)
+	}
+	if *minTTL > 0 && *maxTTL > 0 && *minTTL > *maxTTL {
+		return fmt.Errorf("-min-ttl %d is above -max-ttl %d", *minTTL, *maxTTL)
+	}
+	if *updateMode != "patch" && *updateMode != "recreate" {
+		return fmt.Errorf("Invalid update mode %q", *updateMode)
+	}
+	if *evalOutput {
+		switch {
+		case !*once:
+			return fmt.Errorf("-eval needs -once")
+		case s.spec != nil || len(s.contents) > 0 || *dryRun:
+			return fmt.Errorf("-eval only works for the single record of -n, without -spec, -content or -dry-run")
+		}
+	}
+	if *outputID {
+		switch {
+		case !*once:
+			return fmt.Errorf("-output-record-id needs -once")
+		case *evalOutput:
+			return fmt.Errorf("-output-record-id can't be used with -eval, which prints the IDs already")
+		case s.spec != nil || len(s.contents) > 0 || *dryRun:
+			return fmt.Errorf("-output-record-id only works for the single record of -n, without -spec, -content or -dry-run")
+		}
+	}
+	if *hupAction != "update" && *hupAction != "reload" {
+		return fmt.Errorf("Invalid SIGHUP action %q", *hupAction)
+	}
+	if *hupAction == "reload" && *configFile == "" {
+		return fmt.Errorf("-hup reload needs -config")
+	}
+	// Connecting to syslog is the last thing that can fail
+	if err := setupSyslog(*syslogMode, *syslogFacility, *syslogTag); err != nil {
+		return err
+	}
+	s.apply()
+	return nil
+}
 
-		switch len(aRecs) {
-		case 0:
-			log.Printf("Creating new A record %s.%s", *entryName, *domainName)
-			if err := createRecord(ip); err != nil {
-				log.Printf("Could not create record: %s", err)
+// updateLoop runs an update every -f until stop is done, the first one
+// after first. Depending on -hup, a signal on hup cuts the wait short or
+// reloads the config file. Reloading happens here, between updates, so an
+// update never sees a half-applied config.
+func updateLoop(stop, ctx context.Context, hup <-chan os.Signal, first time.Duration) {
+	timer := time.NewTimer(first)
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop.Done():
+			return
+		case <-timer.C:
+		case sig := <-hup:
+			if *hupAction == "reload" {
+				logInfo("Received %s, reloading %s", sig, *configFile)
+				reloadConfig()
+				continue
 			}
-		case 1:
-			log.Printf("Updating existing A record %s.%s", *entryName, *domainName)
-			if err := updateRecord(aRecs[0], ip); err != nil {
-				log.Printf("Could not update record: %s", err)
+			logInfo("Received %s, updating now", sig)
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		}
+		d := *updateFrequency
+
+		err := runCycle(ctx)
+		health.Set(err)
+		if err != nil {
+			logError("%s", err)
+			summary.Error()
+			if *errorFrequency > 0 {
+				d = *errorFrequency
 			}
-		case 2:
-			log.Printf("Multiple A records matching. Skipping")
 		}
+		timer.Reset(d)
 	}
 }
 
-func externalIP() (string, error) {
-	resp, err := http.Get("http://jsonip.com")
-	if err != nil {
-		return "", err
+// runCycle runs an update, abandoning it once -cycle-deadline has passed.
+func runCycle(ctx context.Context) error {
+	deadline := *cycleDeadline
+	if deadline <= 0 {
+		deadline = *updateFrequency
 	}
-	defer resp.Body.Close()
+	cycle, cancel := context.WithTimeout(ctx, deadline)
+	defer cancel()
 
-	obj := map[string]interface{}{}
-	if err := json.NewDecoder(resp.Body).Decode(&obj); err != nil {
-		return "", err
+	err := runOnce(cycle)
+	if err != nil && cycle.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return fmt.Errorf("Update abandoned after %s to keep to the schedule: %s", deadline, err)
 	}
-	rawIp, ok := obj["ip"]
-	if !ok {
-		return "", fmt.Errorf("No IP field in response")
+	return err
+}
+
+// syncOnce runs updates until one succeeds, making up to attempts of
+// them with growing pauses in between.
+func syncOnce(ctx context.Context, attempts int) error {
+	for attempt := 1; ; attempt++ {
+		err := runOnce(ctx)
+		if err == nil || attempt >= attempts || ctx.Err() != nil {
+			return err
+		}
+		wait := backoff(attempt, 0)
+		logWarn("Update failed (attempt %d of %d), retrying in %s: %s", attempt, attempts, wait, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
 	}
-	ip, ok := rawIp.(string)
-	if !ok {
-		return "", fmt.Errorf("IP has unexpected type")
+}
+
+// waitForAPI blocks until the API answers a request, trying again with
+// growing pauses for up to timeout, or until stop is done. It keeps
+// updates from failing while the network is still coming up at boot.
+func waitForAPI(stop context.Context, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(stop, timeout)
+	defer cancel()
+
+	domain := *domainName
+	if spec != nil && len(spec.Records) > 0 && spec.Records[0].Domain != "" {
+		domain = spec.Records[0].Domain
 	}
-	return ip, nil
+	for attempt := 1; ; attempt++ {
+		err := checkDomain(ctx, domain)
+		// Any answer means the API can be reached. Whether it likes the
+		// request is for the updates to report.
+		var uerr *url.Error
+		if err == nil || !errors.As(err, &uerr) {
+			logInfo("API reachable on attempt %d", attempt)
+			return
+		}
+		if ctx.Err() != nil {
+			logWarn("API still not reachable after %s, starting anyway: %s", timeout, err)
+			return
+		}
+		wait := backoff(attempt, 30*time.Second)
+		logInfo("API not reachable yet, retrying in %s: %s", wait, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
+	}
+}
+
+// minRetryDelay is the shortest pause before any retry, whatever the
+// flags say, so a misconfiguration can't make retries hammer the API.
+const minRetryDelay = 500 * time.Millisecond
+
+// backoff returns the pause before the retry following attempt: -retry-delay
+// doubled for each attempt after the first, up to limit if it is positive,
+// and never less than minRetryDelay. Without a limit the doubling stops
+// before it would overflow.
+func backoff(attempt int, limit time.Duration) time.Duration {
+	wait := *retryDelay
+	for i := 1; i < attempt && wait > 0 && wait <= math.MaxInt64/2 && (limit <= 0 || wait < limit); i++ {
+		wait *= 2
+	}
+	if limit > 0 && wait > limit {
+		wait = limit
+	}
+	if wait < minRetryDelay {
+		wait = minRetryDelay
+	}
+	return wait
 }
 
-func listRecords() (RecordSlice, error) {
-	req, _ := http.NewRequest("GET", fmt.Sprintf("https://%s/v1/domains/%s/records", *apiServer, *domainName), nil)
-	authenticate(req)
-	resp, err := http.DefaultClient.Do(req)
+// runOnce runs an update, giving up once -timeout-budget has passed.
+func runOnce(ctx context.Context) error {
+	start := time.Now()
+	written = nil
+	err := updateWithin(ctx, *timeoutBudget)
+	if err == nil && len(written) > 0 {
+		err = waitForPropagation(ctx, written)
+	}
+	updateDuration.Observe("", time.Since(start).Seconds())
 	if err != nil {
-		return nil, err
+		updateResults.Inc("failure")
+		notify(Event{Kind: EventUpdateFailed, Error: err.Error()})
+	} else {
+		updateResults.Inc("success")
+		if *canaryName != "" && !*dryRun {
+			checkCanary(ctx)
+		}
+	}
+	return err
+}
+
+func updateWithin(ctx context.Context, budget time.Duration) error {
+	if budget <= 0 {
+		return update(ctx)
+	}
+	limited, cancel := context.WithTimeout(ctx, budget)
+	defer cancel()
+	err := update(limited)
+	if err != nil && limited.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return fmt.Errorf("Update timed out after %s: %s", budget, err)
 	}
-	defer resp.Body.Close()
+	return err
+}
 
-	recs := RecordSlice{}
-	err = json.NewDecoder(resp.Body).Decode(&recs)
-	return recs, err
+// update looks up the external IP and updates the records as configured.
+func update(ctx context.Context) error {
+	if *dryRun {
+		logSkip(skipDryRun, "Printing the changes instead of making them")
+		return printPlan(ctx)
+	}
+	if spec != nil {
+		return reconcile(ctx, spec)
+	}
+	if len(contents) > 0 {
+		return syncContents(ctx)
+	}
+	if *detectFamily != "" {
+		return updateFamilies(ctx)
+	}
+	return updateSingle(ctx)
 }
 
-func createRecord(ip string) error {
-	rec := Record{}
-	rec.Record.Name = *entryName
-	rec.Record.Type = "A"
-	rec.Record.Content = ip
-	rec.Record.TTL = 5
-	data, _ := json.Marshal(rec)
+// updateSingle looks up the external IP and points the records of -n and
+// -type at it.
+func updateSingle(ctx context.Context) error {
+	if *seedIP != "" && !seeded {
+		seeded = true
+		created := false
+		err := phase(ctx, "Seeding", *apiTimeout, func(ctx context.Context) (err error) {
+			created, err = seedEntry(ctx)
+			return err
+		})
+		if err != nil || created {
+			return err
+		}
+	}
 
-	req, _ := http.NewRequest("POST", fmt.Sprintf("https://%s/v1/domains/%s/records", *apiServer, *domainName), bytes.NewReader(data))
-	authenticate(req)
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
+	var ip string
+	err := phase(ctx, "IP lookup", 0, func(ctx context.Context) (err error) {
+		ip, err = detectIP(ctx, familyOf(*recordType))
+		return err
+	})
+	if err != nil || ip == "" {
 		return err
 	}
-	if resp.StatusCode != 201 {
-		return fmt.Errorf("Record creation failed: %s (%d)", resp.Status, resp.StatusCode)
+	noteIP(ip)
+	return phase(ctx, "API update", *apiTimeout, func(ctx context.Context) error {
+		return updateEntry(ctx, ip)
+	})
+}
+
+// phase runs fn with ctx limited to timeout, if set, and logs how long it
+// took. Running out of time is reported with the name of the phase.
+func phase(ctx context.Context, name string, timeout time.Duration, fn func(context.Context) error) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
-	return nil
+	start := time.Now()
+	err := fn(ctx)
+	logDebug("%s took %s", name, time.Since(start))
+	if err != nil && timeout > 0 && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s timed out after %s: %s", name, timeout, err)
+	}
+	return err
 }
 
-func updateRecord(rec Record, ip string) error {
-	rec.Record.TTL = 5
-	rec.Record.Content = ip
-	data, _ := json.Marshal(rec)
+// updateEntry points the records matching -n and -type at ip.
+func updateEntry(ctx context.Context, ip string) error {
+	var matches RecordSlice
+	switch {
+	case createdRecord != nil:
+		matches = RecordSlice{*createdRecord}
+		createdRecord = nil
+	case matchCache.fresh():
+		matches = matchCache.recs
+	default:
+		recs, err := entryRecords(ctx)
+		if err != nil {
+			return fmt.Errorf("Could not list records: %s", err)
+		}
+
+		matches = editable(*domainName, recs)
+		matchCache.set(matches)
+	}
 
-	req, _ := http.NewRequest("PUT", fmt.Sprintf("https://%s/v1/domains/%s/records/%d", *apiServer, *domainName, rec.Record.ID), bytes.NewReader(data))
-	authenticate(req)
-	resp, err := http.DefaultClient.Do(req)
+	changes, err := planEntry(matches, ip)
 	if err != nil {
 		return err
 	}
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("Record update failed: %s (%d)", resp.Status, resp.StatusCode)
+	switch len(matches) {
+	case 0:
+		if !approve(fmt.Sprintf("Create %s record %s with %s", *recordType, fqdn(), ip)) {
+			logSkip(skipDeclined, "Not creating %s record %s", *recordType, fqdn())
+			return nil
+		}
+		logInfo("Creating new %s record %s", *recordType, fqdn())
+		rec, err := createRecord(ctx, *domainName, buildPayload(*entryName, *recordType, ip, *recordTTL))
+		recordHistory(*recordType, "", ip, "created", err)
+		matchCache.invalidate()
+		if err != nil {
+			return fmt.Errorf("Could not create record: %s", err)
+		}
+		logSuccess("Created %s record %s (ID %d) with %s", *recordType, fqdn(), rec.Record.ID, ip)
+		published(*domainName, *entryName, *recordType, ip)
+		notifyIPChange(*domainName, *entryName, *recordType, rec.Record.ID, "", ip)
+		noteWritten(rec.Record.ID, "", ip)
+		createdRecord = &rec
+	case 1:
+		c := changes[0]
+		if c.Action == actionNone {
+			return nil
+		}
+		old := c.Old
+		logInfo("Updating existing %s record %s", *recordType, recordFQDN(old.Record.Name, *domainName))
+		rec, err := replaceRecord(ctx, *domainName, old, buildPayload(old.Record.Name, *recordType, ip, c.New.TTL))
+		if err == errDeclined {
+			return nil
+		}
+		recordHistory(*recordType, old.Record.Content, ip, "updated", err)
+		if err != nil {
+			matchCache.invalidate()
+		} else {
+			matchCache.replace(old, rec)
+		}
+		if err == dnsimple.ErrConflict {
+			logSkip(skipConflict, "%s record %s was changed since it was listed", *recordType, recordFQDN(old.Record.Name, *domainName))
+			return fmt.Errorf("%s record %s was changed remotely. Re-reading on the next update", *recordType, recordFQDN(old.Record.Name, *domainName))
+		}
+		if err != nil {
+			return fmt.Errorf("Could not update record: %s", err)
+		}
+		logSuccess("Updated %s record %s to %s (%s)", *recordType, recordFQDN(old.Record.Name, *domainName), ip, contentChange(*recordType, old.Record.Content, ip))
+		published(*domainName, old.Record.Name, *recordType, ip)
+		notifyIPChange(*domainName, old.Record.Name, *recordType, rec.Record.ID, old.Record.Content, ip)
+		noteWritten(rec.Record.ID, old.Record.Content, ip)
+	default:
+		failed := 0
+		for _, c := range changes {
+			if c.Action == actionNone {
+				continue
+			}
+			old := c.Old
+			logInfo("Updating existing %s record %s (ID %d)", *recordType, recordFQDN(old.Record.Name, *domainName), old.Record.ID)
+			rec, err := replaceRecord(ctx, *domainName, old, buildPayload(old.Record.Name, *recordType, ip, c.New.TTL))
+			if err == errDeclined {
+				continue
+			}
+			recordHistory(*recordType, old.Record.Content, ip, "updated", err)
+			if err != nil {
+				logError("Could not update record %d: %s", old.Record.ID, err)
+				failed++
+				continue
+			}
+			matchCache.replace(old, rec)
+			logSuccess("Updated %s record %s (ID %d) to %s (%s)", *recordType, recordFQDN(old.Record.Name, *domainName), old.Record.ID, ip, contentChange(*recordType, old.Record.Content, ip))
+			published(*domainName, old.Record.Name, *recordType, ip)
+			notifyIPChange(*domainName, old.Record.Name, *recordType, rec.Record.ID, old.Record.Content, ip)
+			noteWritten(rec.Record.ID, old.Record.Content, ip)
+		}
+		if failed > 0 {
+			matchCache.invalidate()
+			return fmt.Errorf("Could not update %d of %d records", failed, len(matches))
+		}
 	}
 	return nil
 }
 
-func authenticate(req *http.Request) {
-	req.Header.Add("Accepts", "application/json")
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("X-DNSimple-Domain-Token", *domainToken)
-	req.Close = true
+// planEntry returns the changes that point matches, the records of -n
+// and -type, at ip, with an actionNone entry for each record left as it
+// is. Several matches are only planned for with -allow-multiple and up to
+// -max-records. Updates and -dry-run both plan with it, so they agree.
+func planEntry(matches RecordSlice, ip string) ([]Change, error) {
+	if len(matches) == 0 {
+		return []Change{{Action: actionCreate, New: SpecRecord{Name: *entryName, Type: *recordType, Content: ip, TTL: *recordTTL}}}, nil
+	}
+	if len(matches) > 1 {
+		if !*allowMultiple {
+			logSkip(skipMultiple, "Multiple %s records %s match, see -allow-multiple", *recordType, fqdn())
+			return nil, nil
+		}
+		if err := checkMaxRecords(len(matches)); err != nil {
+			return nil, err
+		}
+	}
+	changes := make([]Change, 0, len(matches))
+	for _, old := range matches {
+		changes = append(changes, Change{
+			Action: entryAction(old, ip),
+			Old:    old,
+			New:    SpecRecord{Name: old.Record.Name, Type: *recordType, Content: ip, TTL: updateTTL(old)},
+		})
+	}
+	return changes, nil
+}
+
+// entryAction returns what an update does to old, a record of -n, to
+// point it at ip. Records that already have ip and the TTL they would be
+// updated with are left alone unless they were last written longer than
+// -max-record-age ago. Records left alone are logged with the reason.
+func entryAction(old Record, ip string) string {
+	if !sameContent(*recordType, old.Record.Content, ip) {
+		if keepNearIP(old, ip) {
+			return actionNone
+		}
+		return actionUpdate
+	}
+	if ttl := clampTTL(updateTTL(old)); ttl != 0 && ttl != old.Record.TTL {
+		return actionUpdate
+	}
+	if isStale(old) {
+		logInfo("%s record %s is up to date but was last written %s, rewriting it", *recordType, recordFQDN(old.Record.Name, *domainName), old.Record.Updated)
+		return actionRefresh
+	}
+	logSkip(skipUnchanged, "%s record %s is up to date", *recordType, recordFQDN(old.Record.Name, *domainName))
+	return actionNone
+}
+
+// keepNearIP reports whether old is left as it is because its address is
+// within -ip-change-threshold of ip, so providers that alternate between
+// neighbouring addresses don't make the record flap.
+func keepNearIP(old Record, ip string) bool {
+	bits := sameNetwork(old.Record.Content, ip)
+	if bits == 0 || old.Record.Content == ip {
+		return false
+	}
+	logSkip(skipThreshold, "%s is within /%d of %s, which %s record %s has", ip, bits, old.Record.Content, old.Record.Type, recordFQDN(old.Record.Name, *domainName))
+	return true
+}
+
+// sameNetwork returns the prefix length of -ip-change-threshold or
+// -ip-change-threshold6 if a and b are addresses of the same family within
+// it, and 0 otherwise.
+func sameNetwork(a, b string) int {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if ipA == nil || ipB == nil || (ipA.To4() == nil) != (ipB.To4() == nil) {
+		return 0
+	}
+	bits, size := *ipThreshold, 32
+	if ipA.To4() == nil {
+		bits, size = *ipThreshold6, 128
+	}
+	if bits <= 0 {
+		return 0
+	}
+	mask := net.CIDRMask(bits, size)
+	if ipA.Mask(mask).Equal(ipB.Mask(mask)) {
+		return bits
+	}
+	return 0
+}
+
+// updateTTL returns the TTL to update old with: -ttl if it was set,
+// otherwise the one old already has.
+func updateTTL(old Record) int {
+	if isSet("ttl") || old.Record.TTL == 0 {
+		return *recordTTL
+	}
+	return old.Record.TTL
+}
+
+// seedEntry creates the record matching -n and -type with -seed-ip if it
+// doesn't exist. It reports whether it did.
+func seedEntry(ctx context.Context) (bool, error) {
+	exists, err := entryExists(ctx)
+	if err != nil {
+		return false, fmt.Errorf("Could not list records: %s", err)
+	}
+	if exists {
+		logDebug("%s record %s exists, not seeding it", *recordType, fqdn())
+		return false, nil
+	}
+	logInfo("Seeding new %s record %s with %s", *recordType, fqdn(), *seedIP)
+	return true, updateEntry(ctx, *seedIP)
+}
+
+// entryExists reports whether there is a record of -n and -type. Without
+// -filter, the listing is only read up to the first one.
+func entryExists(ctx context.Context) (bool, error) {
+	if recordFilter != nil {
+		recs, err := entryRecords(ctx)
+		return len(recs) > 0, err
+	}
+	c, err := api(ctx, *domainName)
+	if err != nil {
+		return false, err
+	}
+	_, found, err := c.FindRecord(ctx, *entryName, *recordType)
+	return found, err
+}
+
+// needsIP reports whether updates use the external IP at all. Records
+// with static content don't.
+func needsIP() bool {
+	recs := contentRecords()
+	switch {
+	case spec != nil:
+		recs = spec.Records
+	case len(contents) == 0:
+		return true
+	}
+	for _, r := range recs {
+		if r.Content == autoContent || isTemplate(r.Content) {
+			return true
+		}
+	}
+	return false
+}
+
+// syncContents gives -n one record per value of -content. Other records
+// of the same name and type are updated to a missing value or deleted.
+func syncContents(ctx context.Context) error {
+	want := contentRecords()
+	var ips map[string]string
+	err := phase(ctx, "IP lookup", 0, func(ctx context.Context) (err error) {
+		ips, err = detectIPs(ctx, want)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, c := range contents {
+		if (c == autoContent || isTemplate(c)) && ips[*recordType] == "" {
+			return nil
+		}
+	}
+	if want, err = renderContents(want, ips); err != nil {
+		return err
+	}
+
+	return phase(ctx, "API update", *apiTimeout, func(ctx context.Context) error {
+		recs, err := listMatching(ctx, *domainName, *entryName, "")
+		if err != nil {
+			return fmt.Errorf("Could not list records: %s", err)
+		}
+		plan := planDomain(editable(*domainName, recs), want, ips, true)
+		if err := checkMaxRecords(countChanges(plan)); err != nil {
+			return err
+		}
+		return applyPlan(ctx, *domainName, plan)
+	})
+}
+
+// contentRecords returns the records -content asks for.
+func contentRecords() []SpecRecord {
+	var recs []SpecRecord
+	for _, c := range contents {
+		r := SpecRecord{Name: *entryName, Type: *recordType, Content: c, TTL: *recordTTL}
+		if r.Type == "SRV" {
+			r.Priority = *srvPriority
+		}
+		recs = append(recs, r)
+	}
+	return recs
+}
+
+// newClient returns a client whose connections originate from the local
+// address bind, if given, and only use IP family 4 or 6, if given.
+func newClient(bind string, family int) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if bind != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(bind)}
+	}
+	dial := dialer.DialContext
+	if family != 0 {
+		network := fmt.Sprintf("tcp%d", family)
+		dial = func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+	t := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dial,
+		MaxIdleConns:        *maxIdleConns,
+		MaxIdleConnsPerHost: *maxIdleConns,
+		IdleConnTimeout:     *idleTimeout,
+		TLSHandshakeTimeout: 10 * time.Second,
+		ForceAttemptHTTP2:   *useHTTP2,
+		// MaxIdleConns 0 means no limit to net/http, not no idle connections
+		DisableKeepAlives: *maxIdleConns == 0,
+	}
+	if !*useHTTP2 {
+		// A non-nil, empty map disables HTTP/2
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return &http.Client{Transport: t}
+}
+
+// check verifies that the IP provider is reachable and that the domain
+// can be accessed with the given token. Nothing is modified.
+func check() bool {
+	ok := true
+	report := func(name string, err error) {
+		if err != nil {
+			fmt.Printf("FAIL  %s: %s\n", name, err)
+			ok = false
+			return
+		}
+		fmt.Printf("PASS  %s\n", name)
+	}
+
+	ctx := context.Background()
+	if needsIP() {
+		ip, err := externalIP(ctx, familyOf(*recordType))
+		report("IP provider", err)
+		if err == nil {
+			logInfo("External IP: %s", ip)
+		}
+	}
+	if spec != nil {
+		for domain := range spec.byDomain() {
+			report("Domain access to "+domain, checkDomain(ctx, domain))
+		}
+	} else {
+		report("Domain access to "+*domainName, checkDomain(ctx, *domainName))
+	}
+	return ok
+}
+
+// recordHistory keeps the result of writing a record of type typ from
+// oldIP to newIP in the update history and counts successful updates.
+func recordHistory(typ, oldIP, newIP, result string, err error) {
+	if err != nil {
+		result = fmt.Sprintf("failed: %s", err)
+	} else {
+		summary.Update()
+		if result == "updated" {
+			recordUpdates.Inc(contentChange(typ, oldIP, newIP))
+		}
+	}
+	updateHistory.Add(HistoryEntry{
+		Time:   time.Now(),
+		OldIP:  oldIP,
+		NewIP:  newIP,
+		Result: result,
+	})
+}
+
+// contentChange tells whether an update of a record of type typ from old
+// to new content actually changed anything or merely wrote the same
+// content again.
+func contentChange(typ, old, new string) string {
+	if sameContent(typ, old, new) {
+		return "ip_refreshed"
+	}
+	return "ip_changed"
+}
+
+func serveHTTP() {
+	mux := http.NewServeMux()
+	mux.Handle("/history", updateHistory)
+	mux.HandleFunc("/metrics", serveMetrics)
+	mux.Handle("/healthz", health)
+	log.Fatalf("Could not serve HTTP: %s", http.ListenAndServe(*listenAddr, mux))
+}
+
+// listTypes prints the record types accepted by -type.
+func listTypes() {
+	types := make([]string, 0, len(recordTypes))
+	for t := range recordTypes {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		fmt.Printf("%-6s %s\n", t, recordTypes[t])
+	}
+}
+
+// fqdn returns the fully qualified name of the managed entry.
+func fqdn() string {
+	return recordFQDN(*entryName, *domainName)
+}
+
+func recordFQDN(name, domain string) string {
+	if name == "" {
+		return domain
+	}
+	return name + "." + domain
+}
+
+// relativeName turns name into a label relative to domain as DNSimple
+// expects it. "@" and the domain itself mean the apex, which is an empty
+// name. A fully qualified name within domain has the domain stripped.
+func relativeName(name, domain string) (string, error) {
+	orig := name
+	name = strings.TrimSuffix(name, ".")
+	switch {
+	case name == "@":
+		return "", nil
+	case domain != "" && name == domain:
+		logWarn("Warning: %q is the domain itself, using the apex", orig)
+		return "", nil
+	case domain != "" && strings.HasSuffix(name, "."+domain):
+		name = strings.TrimSuffix(name, "."+domain)
+		logWarn("Warning: %q already contains the domain, using %q", orig, name)
+	case strings.HasSuffix(orig, "."):
+		return "", fmt.Errorf("%q is fully qualified but not within %s", orig, domain)
+	case strings.Contains(name, ".") && !strings.HasPrefix(name, "_"):
+		// Service names like _sip._tcp are meant to have dots
+		logWarn("Warning: %q contains dots and will be %s", orig, recordFQDN(name, domain))
+	}
+	if strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".") || strings.Contains(name, "..") {
+		return "", fmt.Errorf("Invalid entry name %q", orig)
+	}
+	return name, nil
+}
+
+// nameContext is what -n-template is executed against.
+type nameContext struct {
+	Hostname      string
+	ShortHostname string
+	Env           map[string]string
+}
+
+// renderName executes the -n-template text and makes sure the result is
+// a valid name.
+func renderName(text string) (string, error) {
+	tmpl, err := template.New("n-template").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("Invalid -n-template: %s", err)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("Could not get the host name for -n-template: %s", err)
+	}
+	ctx := nameContext{
+		Hostname:      hostname,
+		ShortHostname: strings.SplitN(hostname, ".", 2)[0],
+		Env:           map[string]string{},
+	}
+	for _, kv := range os.Environ() {
+		parts := strings.SplitN(kv, "=", 2)
+		ctx.Env[parts[0]] = parts[1]
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, ctx); err != nil {
+		return "", fmt.Errorf("Could not execute -n-template: %s", err)
+	}
+	name := b.String()
+	ascii, err := checkHostname(name)
+	if err != nil {
+		return "", fmt.Errorf("-n-template resulted in %q, which is %s", name, err)
+	}
+	for _, label := range strings.Split(ascii, ".") {
+		if len(label) > 63 {
+			return "", fmt.Errorf("-n-template resulted in %q, whose label %q is longer than 63 characters", name, label)
+		}
+	}
+	logInfo("Using %q as entry name", ascii)
+	return ascii, nil
+}
+
+// contentContext is what templates in -content are executed against.
+type contentContext struct {
+	IP       string
+	Hostname string
+	Now      string
+}
+
+// isTemplate reports whether content is a template to execute on each
+// update rather than the literal content.
+func isTemplate(content string) bool {
+	return strings.Contains(content, "{{")
+}
+
+// checkContentTemplate parses text and tries it out, so mistakes show at
+// startup rather than on every update.
+func checkContentTemplate(text string) error {
+	_, err := executeContent(text, contentContext{IP: "192.0.2.1", Hostname: "host", Now: time.Now().UTC().Format(time.RFC3339)})
+	return err
+}
+
+// renderContents returns recs with the templates among their contents
+// executed for the external IP ips holds for their type.
+func renderContents(recs []SpecRecord, ips map[string]string) ([]SpecRecord, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("Could not get the host name for -content: %s", err)
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	rendered := make([]SpecRecord, len(recs))
+	for i, r := range recs {
+		if isTemplate(r.Content) {
+			if r.Content, err = executeContent(r.Content, contentContext{ips[r.Type], hostname, now}); err != nil {
+				return nil, err
+			}
+		}
+		rendered[i] = r
+	}
+	return rendered, nil
+}
+
+func executeContent(text string, ctx contentContext) (string, error) {
+	tmpl, err := template.New("content").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("Invalid template %q in -content: %s", text, err)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, ctx); err != nil {
+		return "", fmt.Errorf("Could not execute template %q in -content: %s", text, err)
+	}
+	return b.String(), nil
+}
+
+// parseIPMap parses a list of from=to IP pairs as given to -ip-map.
+func parseIPMap(s string) (map[string]string, error) {
+	m := map[string]string{}
+	if s == "" {
+		return m, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid IP mapping %q, expected from=to", pair)
+		}
+		from, to := net.ParseIP(parts[0]), net.ParseIP(parts[1])
+		if from == nil || to == nil {
+			return nil, fmt.Errorf("Invalid IP mapping %q", pair)
+		}
+		m[from.String()] = to.String()
+	}
+	return m, nil
+}
+
+// parseContents splits s into the contents of records of type typ,
+// making sure addresses are of the right family.
+func parseContents(s, typ string) ([]string, error) {
+	var contents []string
+	seen := map[string]bool{}
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if isTemplate(c) {
+			if typ != "TXT" {
+				return nil, fmt.Errorf("Templates in -content are only supported for TXT records")
+			}
+			if err := checkContentTemplate(c); err != nil {
+				return nil, err
+			}
+		}
+		if family := familyOf(typ); family != 0 && c != autoContent {
+			ip := net.ParseIP(c)
+			if ip == nil || (ip.To4() != nil) != (family == 4) {
+				return nil, fmt.Errorf("Invalid content %q for %s records", c, typ)
+			}
+			c = ip.String()
+		}
+		if typ == "SRV" {
+			if err := checkSRV(c); err != nil {
+				return nil, fmt.Errorf("Invalid content %q for SRV records: %s", c, err)
+			}
+		}
+		if typ == "ALIAS" || typ == "CNAME" {
+			host, err := checkHostname(c)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid content %q for %s records: %s", c, typ, err)
+			}
+			c = host
+		}
+		if seen[c] {
+			return nil, fmt.Errorf("Content %q is given twice", c)
+		}
+		seen[c] = true
+		contents = append(contents, c)
+	}
+	return contents, nil
+}
+
+// checkSRV makes sure content is the weight, port and target of an SRV
+// record, which is how the API expects it. The priority is separate.
+func checkSRV(content string) error {
+	fields := strings.Fields(content)
+	if len(fields) != 3 {
+		return fmt.Errorf("expected weight, port and target")
+	}
+	weight, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return fmt.Errorf("invalid weight %q", fields[0])
+	}
+	if err := checkUint16("weight", weight); err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(fields[1])
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("invalid port %q", fields[1])
+	}
+	if fields[2] == "" {
+		return fmt.Errorf("missing target")
+	}
+	return nil
+}
+
+// checkHostname makes sure name is a valid host name and returns it in
+// its ASCII form without a trailing dot.
+func checkHostname(name string) (string, error) {
+	ascii, err := toASCII(strings.TrimSuffix(name, "."))
+	if err != nil {
+		return "", err
+	}
+	if ascii == "" || len(ascii) > 253 {
+		return "", fmt.Errorf("not a host name")
+	}
+	for _, label := range strings.Split(ascii, ".") {
+		if label == "" || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return "", fmt.Errorf("invalid label %q", label)
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-') {
+				return "", fmt.Errorf("invalid label %q", label)
+			}
+		}
+	}
+	return ascii, nil
+}
+
+// checkUint16 makes sure v fits the 16 bit fields of SRV records.
+func checkUint16(name string, v int) error {
+	if v < 0 || v > 65535 {
+		return fmt.Errorf("%s %d is out of range (0-65535)", name, v)
+	}
+	return nil
+}
+
+// parseCIDRs parses a comma separated list of networks. Plain addresses
+// stand for a network of their own.
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if ip := net.ParseIP(c); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid network %q", c)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// familyOf returns the IP family the content of a record of type typ
+// belongs to, or 0 if it isn't an address.
+func familyOf(typ string) int {
+	switch typ {
+	case "A":
+		return 4
+	case "AAAA":
+		return 6
+	}
+	return 0
+}
+
+// detectIP looks up the external IP of the given family. If it is not a
+// public address and -reject-private is set, it returns an empty IP and
+// no error.
+func detectIP(ctx context.Context, family int) (string, error) {
+	ip, err := externalIP(ctx, family)
+	if err != nil {
+		known, ok := knownIP(family)
+		if !ok || *staleIPGrace <= 0 || ctx.Err() != nil {
+			return "", fmt.Errorf("Could not obtain external IP: %s", err)
+		}
+		if time.Since(known.Seen) > *staleIPGrace {
+			return "", fmt.Errorf("Could not obtain external IP, and the last known one is older than -stale-ip-grace: %s", err)
+		}
+		logWarn("Could not obtain external IP, keeping %s seen %s ago: %s", known.IP, time.Since(known.Seen).Round(time.Second), err)
+		return known.IP, nil
+	}
+	logInfo("External IP: %s", ip)
+	if !isAccepted(net.ParseIP(ip)) {
+		logSkip(skipNotAccepted, "%s is not within -accept-cidr", ip)
+		return "", nil
+	}
+	if mapped, ok := ipMap[net.ParseIP(ip).String()]; ok {
+		logInfo("Mapping %s to %s", ip, mapped)
+		ip = mapped
+	}
+	if *rejectPrivate && !isPublicIP(net.ParseIP(ip)) {
+		logSkip(skipPrivateIP, "%s is not a public address", ip)
+		return "", nil
+	}
+	summary.SetIP(ip)
+	rememberIP(family, ip)
+	return ip, nil
+}
+
+// isAccepted reports whether ip is within one of -accept-cidr, if any
+// are given.
+func isAccepted(ip net.IP) bool {
+	if len(acceptNets) == 0 {
+		return true
+	}
+	for _, n := range acceptNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipProviderFor returns the IP provider to ask for an address of family.
+func ipProviderFor(family int) string {
+	switch {
+	case family == 4 && *ipURL4 != "":
+		return *ipURL4
+	case family == 6 && *ipURL6 != "":
+		return *ipURL6
+	}
+	return *ipURL
+}
+
+// checkProvider makes sure the IP provider at rawurl is asked over HTTPS,
+// unless -allow-insecure-ip is set. The address it returns ends up in DNS,
+// so it must not be open to tampering on the way.
+func checkProvider(rawurl string) error {
+	if rawurl == "" {
+		return nil
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return fmt.Errorf("Invalid IP provider %q: %s", rawurl, err)
+	}
+	switch {
+	case u.Scheme == "https":
+	case u.Scheme == "http" && *allowInsecureIP:
+	case u.Scheme == "http":
+		return fmt.Errorf("IP provider %s does not use HTTPS (see -allow-insecure-ip)", rawurl)
+	default:
+		return fmt.Errorf("Invalid IP provider %q", rawurl)
+	}
+	return nil
+}
+
+// redirectPolicy returns a CheckRedirect function for an http.Client that
+// applies -follow-redirects and -max-redirects. If check is given, it must
+// also accept the URL redirected to.
+func redirectPolicy(check func(string) error) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if !*followRedirects {
+			return fmt.Errorf("Redirected to %s (see -follow-redirects)", req.URL.Redacted())
+		}
+		// via holds the original request as well
+		if len(via) > *maxRedirects {
+			return fmt.Errorf("Stopped after %d redirects at %s", *maxRedirects, req.URL.Redacted())
+		}
+		if check != nil {
+			return check(req.URL.String())
+		}
+		return nil
+	}
+}
+
+// externalIP looks up the external IP of family 4 or 6, or of either
+// family if 0.
+func externalIP(ctx context.Context, family int) (string, error) {
+	ip, err := lookupIP(ctx, family)
+	if err != nil {
+		return "", err
+	}
+	isIPv4 := net.ParseIP(ip).To4() != nil
+	if family == 4 && !isIPv4 || family == 6 && isIPv4 {
+		return "", fmt.Errorf("Expected an IPv%d address, got %s", family, ip)
+	}
+	return ip, nil
+}
+
+// lookupIP asks the providers for family in turn until one of them knows
+// the external IP. With -provider-health, providers that failed recently
+// are asked last.
+func lookupIP(ctx context.Context, family int) (string, error) {
+	providers := providersFor(family)
+	healthy, demoted := providerHealth.Order(providers)
+	var errs []string
+	for i, p := range append(healthy, demoted...) {
+		if i == len(healthy) {
+			logInfo("Asking IP providers that failed recently")
+		}
+		start := time.Now()
+		ip, err := askRetrying(ctx, p, family)
+		elapsed := time.Since(start)
+		ipLookupDuration.Observe(p.String(), elapsed.Seconds())
+		logDebug("IP lookup from %s took %s", p, elapsed)
+		if err == nil {
+			providerHealth.Report(p, elapsed, nil)
+			return ip.String(), nil
+		}
+		if ctx.Err() != nil {
+			return "", err
+		}
+		providerHealth.Report(p, elapsed, err)
+		if len(providers) == 1 {
+			return "", err
+		}
+		logWarn("IP lookup from %s failed: %s", p, err)
+		errs = append(errs, fmt.Sprintf("%s: %s", p, err))
+	}
+	return "", fmt.Errorf("All IP providers failed: %s", strings.Join(errs, "; "))
+}
+
+// askRetrying asks p for the external IP, asking again up to -ip-retries
+// times while it answers with a status of -ip-retry-status. Other errors
+// are returned right away, so the next provider is asked.
+func askRetrying(ctx context.Context, p dnsimple.IPProvider, family int) (net.IP, error) {
+	for attempt := 1; ; attempt++ {
+		ip, err := askProvider(ctx, p, family)
+		serr, ok := err.(*dnsimple.StatusError)
+		if !ok || !ipRetryCodes[serr.Code] || attempt > *ipRetries {
+			return ip, err
+		}
+		wait := backoff(attempt, 10*time.Second)
+		logWarn("IP provider %s returned %s, asking again in %s", p, serr.Status, wait)
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// parseStatusCodes parses a list of HTTP status codes and ranges of them
+// like 500-599, as given to -ip-retry-status.
+func parseStatusCodes(s string) (map[int]bool, error) {
+	codes := map[int]bool{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		bounds := strings.SplitN(item, "-", 2)
+		from, err := strconv.Atoi(bounds[0])
+		to := from
+		if err == nil && len(bounds) == 2 {
+			to, err = strconv.Atoi(bounds[1])
+		}
+		if err != nil || from < 100 || to > 599 || from > to {
+			return nil, fmt.Errorf("Invalid status code %q in -ip-retry-status", item)
+		}
+		for code := from; code <= to; code++ {
+			codes[code] = true
+		}
+	}
+	return codes, nil
+}
+
+// askProvider asks p for the external IP, giving up after -ip-timeout.
+// The provider is left behind rather than waited for if it ignores the
+// cancellation, so a single stuck lookup can't hold up the updates.
+func askProvider(ctx context.Context, p dnsimple.IPProvider, family int) (net.IP, error) {
+	if *ipTimeout <= 0 {
+		return p.ExternalIP(ctx, family)
+	}
+	ctx, cancel := context.WithTimeout(ctx, *ipTimeout)
+	defer cancel()
+
+	type result struct {
+		ip  net.IP
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		ip, err := p.ExternalIP(ctx, family)
+		done <- result{ip, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil && ctx.Err() == context.DeadlineExceeded {
+			break
+		}
+		return r.ip, r.err
+	case <-ctx.Done():
+		if ctx.Err() != context.DeadlineExceeded {
+			return nil, ctx.Err()
+		}
+	}
+	logWarn("IP lookup from %s cancelled after %s", p, *ipTimeout)
+	return nil, fmt.Errorf("No answer within %s", *ipTimeout)
+}
+
+// providersFor returns the IP providers to ask for an address of family,
+// as given by -ip-providers or the older flags for a single provider.
+func providersFor(family int) []dnsimple.IPProvider {
+	switch {
+	case *forceIP != "":
+		return []dnsimple.IPProvider{&dnsimple.StaticProvider{IP: net.ParseIP(*forceIP)}}
+	case *ipFile != "":
+		return []dnsimple.IPProvider{&dnsimple.FileProvider{Path: *ipFile}}
+	case *ipProviders != "":
+		providers, _ := parseProviders(*ipProviders, family)
+		return providers
+	case *ipHeader != "":
+		return []dnsimple.IPProvider{&dnsimple.HTTPHeaderProvider{
+			URL:    ipProviderFor(family),
+			Header: *ipHeader,
+			Client: ipClients[family],
+			Skip: func(ip net.IP) bool {
+				return isTrustedProxy(ip) || *rejectPrivate && !isPublicIP(ip) ||
+					family == 4 && ip.To4() == nil || family == 6 && ip.To4() != nil
+			},
+		}}
+	}
+	return []dnsimple.IPProvider{&dnsimple.HTTPJSONProvider{URL: ipProviderFor(family), Client: ipClients[family]}}
+}
+
+// parseProviders parses a list of IP providers as given to -ip-providers.
+// HTTP providers use the client for family.
+func parseProviders(s string, family int) ([]dnsimple.IPProvider, error) {
+	var providers []dnsimple.IPProvider
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		parts := strings.SplitN(p, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid IP provider %q, expected kind:argument", p)
+		}
+		kind, arg := parts[0], parts[1]
+		switch kind {
+		case "json", "text":
+			if err := checkProvider(arg); err != nil {
+				return nil, err
+			}
+			if kind == "json" {
+				providers = append(providers, &dnsimple.HTTPJSONProvider{URL: arg, Client: ipClients[family]})
+			} else {
+				providers = append(providers, &dnsimple.HTTPTextProvider{URL: arg, Client: ipClients[family]})
+			}
+		case "dns":
+			name := strings.SplitN(arg, "@", 2)
+			if len(name) != 2 || name[0] == "" || name[1] == "" {
+				return nil, fmt.Errorf("Invalid IP provider %q, expected dns:NAME@SERVER", p)
+			}
+			providers = append(providers, &dnsimple.DNSProvider{Name: name[0], Server: name[1]})
+		case "iface":
+			providers = append(providers, &dnsimple.InterfaceProvider{Name: arg})
+		case "file":
+			providers = append(providers, &dnsimple.FileProvider{Path: arg})
+		default:
+			return nil, fmt.Errorf("Unknown kind of IP provider %q", kind)
+		}
+	}
+	if len(providers) == 0 {
+		return nil, fmt.Errorf("No IP providers given")
+	}
+	return providers, nil
+}
+
+// isTrustedProxy reports whether ip is within -trusted-proxies.
+func isTrustedProxy(ip net.IP) bool {
+	for _, n := range trustedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// sharedAddressSpace is the carrier-grade NAT range from RFC 6598.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isPublicIP reports whether ip is a globally routable unicast address.
+func isPublicIP(ip net.IP) bool {
+	if ip == nil || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	return !sharedAddressSpace.Contains(ip)
+}
+
+// accounts caches the v2 account IDs found for each token.
+var (
+	accountsMu sync.Mutex
+	accounts   = map[string]string{}
+)
+
+// api returns a client for the records of domain. For v2, the account is
+// looked up the first time a token is used, unless -account is set.
+func api(ctx context.Context, domain string) (*dnsimple.Client, error) {
+	c := &dnsimple.Client{
+		BaseURL:          fmt.Sprintf("%s://%s", apiScheme, *apiServer),
+		ReadURL:          readURL(),
+		Domain:           domain,
+		Token:            tokenFor(domain),
+		Version:          *apiVersion,
+		Backend:          backends[*backendName],
+		StrictJSON:       *strictJSON,
+		Account:          *accountID,
+		HTTPClient:       client,
+		PerPage:          *recordsPerPage,
+		CloseConnections: *maxIdleConns == 0,
+	}
+	if c.Version != 2 || c.Account != "" {
+		return c, nil
+	}
+	accountsMu.Lock()
+	account, ok := accounts[c.Token]
+	accountsMu.Unlock()
+	if ok {
+		c.Account = account
+		return c, nil
+	}
+	account, err := c.DiscoverAccount(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Could not find the account for %s, set -account: %s", domain, err)
+	}
+	logInfo("Using account %s for %s", account, domain)
+	accountsMu.Lock()
+	accounts[c.Token] = account
+	accountsMu.Unlock()
+	c.Account = account
+	return c, nil
+}
+
+// readURL returns the base URL of -read-server, or "" to read from -s.
+func readURL() string {
+	if *readServer == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s://%s", apiScheme, *readServer)
+}
+
+// listRecords returns all records of domain.
+func listRecords(ctx context.Context, domain string) (RecordSlice, error) {
+	c, err := api(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	recs, err := c.ListRecords(ctx)
+	return RecordSlice(recs), err
+}
+
+// entryRecords returns the records of -d the single entry updates: those
+// picked by -filter if set, otherwise those matching -n and -type. Only
+// records of -type are ever returned, as the content written depends on
+// it.
+func entryRecords(ctx context.Context) (RecordSlice, error) {
+	if recordFilter == nil {
+		return listMatching(ctx, *domainName, *entryName, *recordType)
+	}
+	recs, err := listRecords(ctx, *domainName)
+	if err != nil {
+		return nil, err
+	}
+	return recs.Where(recordFilter).Where(func(r Record) bool {
+		return r.Record.Type == *recordType
+	}), nil
+}
+
+// listMatching returns the records of domain named name and, unless typ
+// is empty, of type typ, letting the API filter them where it can.
+func listMatching(ctx context.Context, domain, name, typ string) (RecordSlice, error) {
+	c, err := api(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	recs, err := c.ListMatchingRecords(ctx, name, typ)
+	return RecordSlice(recs), err
+}
+
+func checkDomain(ctx context.Context, domain string) error {
+	c, err := api(ctx, domain)
+	if err != nil {
+		return err
+	}
+	return c.CheckDomain(ctx)
+}
+
+// buildPayload returns the record sent on create and update. Both paths
+// go through here so they never diverge in which fields they set.
+func buildPayload(name, typ, content string, ttl int) Record {
+	if clamped := clampTTL(ttl); clamped != ttl {
+		logInfo("Clamping TTL %d of %s record %q to %d", ttl, typ, name, clamped)
+		ttl = clamped
+	}
+	return dnsimple.NewRecord(name, typ, content, ttl)
+}
+
+// clampTTL keeps ttl within -min-ttl and -max-ttl. A TTL of 0 leaves the
+// choice to the server and is not touched.
+func clampTTL(ttl int) int {
+	if ttl == 0 {
+		return 0
+	}
+	if *minTTL > 0 && ttl < *minTTL {
+		return *minTTL
+	}
+	if *maxTTL > 0 && ttl > *maxTTL {
+		return *maxTTL
+	}
+	return ttl
+}
+
+func createRecord(ctx context.Context, domain string, rec Record) (Record, error) {
+	c, err := api(ctx, domain)
+	if err != nil {
+		return Record{}, err
+	}
+	return c.CreateRecord(ctx, rec)
+}
+
+// updateRecord replaces old with rec, unless old was changed in the
+// meantime.
+func updateRecord(ctx context.Context, domain string, old Record, rec Record) (Record, error) {
+	c, err := api(ctx, domain)
+	if err != nil {
+		return Record{}, err
+	}
+	return c.UpdateRecord(ctx, old, rec)
+}
+
+// replaceRecord changes old to rec according to -update-mode and returns
+// the new record. Recreating creates the new record before deleting the
+// old one so the name never goes unresolved, at the cost of briefly
+// having both. With -interactive, both steps are asked about; errDeclined
+// is returned if the new record isn't created.
+func replaceRecord(ctx context.Context, domain string, old Record, rec Record) (Record, error) {
+	if *updateMode != "recreate" {
+		return updateRecord(ctx, domain, old, rec)
+	}
+
+	name := recordFQDN(old.Record.Name, domain)
+	if !approve(fmt.Sprintf("Create %s record %s with %s to replace record %d", rec.Record.Type, name, rec.Record.Content, old.Record.ID)) {
+		logSkip(skipDeclined, "Not replacing %s record %s (ID %d)", old.Record.Type, name, old.Record.ID)
+		return Record{}, errDeclined
+	}
+	created, err := createRecord(ctx, domain, rec)
+	if err != nil {
+		return Record{}, err
+	}
+	if !approve(fmt.Sprintf("Delete old %s record %s (ID %d) with %s", old.Record.Type, name, old.Record.ID, old.Record.Content)) {
+		logSkip(skipDeclined, "Not deleting old record %d, it remains next to new record %d", old.Record.ID, created.Record.ID)
+		return created, nil
+	}
+	logInfo("Created record %d, deleting old record %d", created.Record.ID, old.Record.ID)
+	if err := deleteRecord(ctx, domain, old.Record.ID); err != nil {
+		return created, fmt.Errorf("Old record %d remains next to new record %d: %s", old.Record.ID, created.Record.ID, err)
+	}
+	return created, nil
+}
+
+// tokenFor returns the token to use for domain, which is -t unless the
+// spec names a different one.
+func tokenFor(domain string) string {
+	return spec.token(domain)
+}
+
+func deleteRecord(ctx context.Context, domain string, id int) error {
+	c, err := api(ctx, domain)
+	if err != nil {
+		return err
+	}
+	return c.DeleteRecord(ctx, id)
 }
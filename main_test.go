@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/surma-dump/dnsimple-updater/dnsimple"
+	"github.com/surma-dump/dnsimple-updater/dnsimple/dnsimpletest"
+)
+
+var updateGolden = flag.Bool("update", false, "Rewrite the golden files with the requests sent")
+
+// testSetup points the updater at srv for example.com, sets the flags in
+// args as if given on the command line and runs setup. Flags are given as
+// -name=value, or -name for booleans. The flags and what is kept between
+// updates are reset when the test ends.
+func testSetup(t *testing.T, srv *dnsimpletest.Server, args ...string) {
+	t.Helper()
+	saved := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		saved[f.Name] = f.Value.String()
+	})
+	t.Cleanup(func() {
+		for name, v := range saved {
+			// Reset first so that list flags don't append to the old value
+			fl := flag.Lookup(name)
+			fl.Value.Set(fl.DefValue)
+			fl.Value.Set(v)
+		}
+		commandLine = map[string]bool{}
+		resetState()
+	})
+	resetState()
+
+	args = append([]string{"-t=token", "-d=example.com", "-s=" + srv.Host()}, args...)
+	for _, arg := range args {
+		kv := strings.SplitN(strings.TrimPrefix(arg, "-"), "=", 2)
+		if len(kv) == 1 {
+			kv = append(kv, "true")
+		}
+		fl := flag.Lookup(kv[0])
+		if fl == nil {
+			t.Fatalf("Unknown flag %s", arg)
+		}
+		if err := fl.Value.Set(kv[1]); err != nil {
+			t.Fatalf("Invalid flag %s: %s", arg, err)
+		}
+		commandLine[kv[0]] = true
+	}
+	if err := setup(); err != nil {
+		t.Fatal(err)
+	}
+	setupClients()
+	apiScheme = "http"
+}
+
+// resetState forgets what the updates kept for the next one.
+func resetState() {
+	apiScheme = "https"
+	spec = nil
+	createdRecord = nil
+	seeded = false
+	matchCache = &RecordCache{}
+	familyStates = map[string]*familyState{}
+	probedFamilies = nil
+	updateHistory = NewHistory(10)
+	notifier = nil
+	canaryLast = 0
+	written = nil
+	summary = NewSummary()
+	providerHealth = &ProviderHealth{states: map[string]*providerState{}}
+	stateMu.Lock()
+	state = State{IPs: map[int]KnownIP{}}
+	stateMu.Unlock()
+}
+
+// checkGolden compares the requests srv received that change records
+// with the golden file name in testdata. Run with -update to accept
+// changes.
+func checkGolden(t *testing.T, srv *dnsimpletest.Server, name string) {
+	t.Helper()
+	var got bytes.Buffer
+	for _, r := range srv.Writes() {
+		got.WriteString(r.Method + " " + r.Path + "\n")
+		got.Write(r.Body)
+		got.WriteString("\n")
+	}
+	path := filepath.Join("testdata", name+".golden")
+	if *updateGolden {
+		if err := ioutil.WriteFile(path, got.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("Sent\n%s\nexpected\n%s", got.Bytes(), want)
+	}
+}
+
+// TestRunOnce creates a record and updates it after the IP changed, and
+// compares what was sent with the golden files.
+func TestRunOnce(t *testing.T) {
+	tests := []struct {
+		golden string
+		args   []string
+		ips    []string
+	}{
+		{"once-v1-a", []string{"-n=home", "-ttl=60"}, []string{"203.0.113.9", "203.0.113.10"}},
+		{"once-v1-aaaa", []string{"-n=home", "-type=AAAA", "-ttl=60"}, []string{"2001:db8::9", "2001:db8::10"}},
+		{"once-v1-default-ttl", []string{"-n=home"}, []string{"203.0.113.9", "203.0.113.10"}},
+		{"once-v2-a", []string{"-n=home", "-api-version=2", "-account=1010", "-ttl=300"}, []string{"203.0.113.9", "203.0.113.10"}},
+		{"once-v2-aaaa", []string{"-n=home", "-type=AAAA", "-api-version=2", "-account=1010"}, []string{"2001:db8::9", "2001:db8::10"}},
+	}
+	for _, test := range tests {
+		t.Run(test.golden, func(t *testing.T) {
+			srv := dnsimpletest.NewServer()
+			defer srv.Close()
+			testSetup(t, srv, test.args...)
+			for _, ip := range test.ips {
+				*forceIP = ip
+				if err := runOnce(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			checkGolden(t, srv, test.golden)
+		})
+	}
+}
+
+// TestBuildPayload checks the records created and updated with, which
+// are built the same way for both.
+func TestBuildPayload(t *testing.T) {
+	tests := []struct {
+		name, typ, content string
+		ttl, min, max      int
+		wantTTL            int
+	}{
+		{"home", "A", "203.0.113.9", 60, 0, 0, 60},
+		{"", "A", "203.0.113.9", 60, 0, 0, 60},
+		{"home", "AAAA", "2001:db8::9", 3600, 0, 0, 3600},
+		{"home", "A", "203.0.113.9", 0, 120, 600, 0},
+		{"home", "A", "203.0.113.9", 60, 120, 600, 120},
+		{"home", "A", "203.0.113.9", 3600, 120, 600, 600},
+		{"_acme-challenge", "TXT", "token", 60, 0, 0, 60},
+	}
+	defer func(min, max int) {
+		*minTTL, *maxTTL = min, max
+	}(*minTTL, *maxTTL)
+	for _, test := range tests {
+		*minTTL, *maxTTL = test.min, test.max
+		rec := buildPayload(test.name, test.typ, test.content, test.ttl).Record
+		if rec.Name != test.name || rec.Type != test.typ || rec.Content != test.content || rec.TTL != test.wantTTL || rec.ID != 0 {
+			t.Errorf("buildPayload(%q, %q, %q, %d) with TTLs %d-%d = %+v", test.name, test.typ, test.content, test.ttl, test.min, test.max, rec)
+		}
+	}
+}
+
+func TestRelativeName(t *testing.T) {
+	tests := []struct {
+		name, want string
+		ok         bool
+	}{
+		{"", "", true},
+		{"@", "", true},
+		{"@.", "", true},
+		{"example.com", "", true},
+		{"example.com.", "", true},
+		{"home", "home", true},
+		{"home.example.com", "home", true},
+		{"home.example.com.", "home", true},
+		{"a.b.example.com.", "a.b", true},
+		{"a.b", "a.b", true},
+		{"_acme-challenge", "_acme-challenge", true},
+		{"_sip._tcp", "_sip._tcp", true},
+		{"*", "*", true},
+		{"home.example.org.", "", false},
+		{"home.", "", false},
+		{".home", "", false},
+		{"a..b", "", false},
+	}
+	for _, test := range tests {
+		got, err := relativeName(test.name, "example.com")
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("relativeName(%q) = %q, %v; expected %q", test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestRecordFQDN(t *testing.T) {
+	tests := []struct {
+		name, domain, want string
+	}{
+		{"", "example.com", "example.com"},
+		{"home", "example.com", "home.example.com"},
+		{"a.b", "example.com", "a.b.example.com"},
+		{"_acme-challenge.home", "example.com", "_acme-challenge.home.example.com"},
+		{"*", "example.com", "*.example.com"},
+		{"home", "xn--bcher-kva.example", "home.xn--bcher-kva.example"},
+	}
+	for _, test := range tests {
+		if got := recordFQDN(test.name, test.domain); got != test.want {
+			t.Errorf("recordFQDN(%q, %q) = %q, expected %q", test.name, test.domain, got, test.want)
+		}
+	}
+}
+
+// TestBackoffFloor checks that no retry comes sooner than minRetryDelay,
+// even with a base delay that setup would have raised.
+func TestBackoffFloor(t *testing.T) {
+	defer func(d time.Duration) { *retryDelay = d }(*retryDelay)
+	for _, base := range []time.Duration{-time.Second, 0, time.Millisecond, 499 * time.Millisecond, minRetryDelay, 2 * time.Second} {
+		for _, limit := range []time.Duration{0, 100 * time.Millisecond, time.Second, 10 * time.Second} {
+			*retryDelay = base
+			prev := time.Duration(0)
+			for attempt := 1; attempt <= 40; attempt++ {
+				// Called repeatedly in case the delay ever varies
+				for i := 0; i < 10; i++ {
+					wait := backoff(attempt, limit)
+					if wait < minRetryDelay {
+						t.Fatalf("backoff(%d, %s) with -retry-delay %s = %s, below %s", attempt, limit, base, wait, minRetryDelay)
+					}
+					if limit > minRetryDelay && wait > limit {
+						t.Fatalf("backoff(%d, %s) with -retry-delay %s = %s, above the limit", attempt, limit, base, wait)
+					}
+					if wait < prev {
+						t.Fatalf("backoff(%d, %s) with -retry-delay %s = %s, shorter than before", attempt, limit, base, wait)
+					}
+					prev = wait
+				}
+			}
+		}
+	}
+}
+
+// TestSkipUnchanged updates records that may already have the IP and
+// counts the writes and the updates skipped as unchanged.
+func TestSkipUnchanged(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		existing  []dnsimple.Record
+		ips       []string
+		wantSkips uint64
+		// wantWrites is the number of requests changing records
+		wantWrites int
+	}{
+		{"created", []string{"-n=home"}, nil, []string{"203.0.113.9", "203.0.113.9"}, 1, 1},
+		{"existing", []string{"-n=home"}, []dnsimple.Record{dnsimple.NewRecord("home", "A", "203.0.113.9", 60)}, []string{"203.0.113.9"}, 1, 0},
+		{"changed", []string{"-n=home"}, []dnsimple.Record{dnsimple.NewRecord("home", "A", "203.0.113.8", 60)}, []string{"203.0.113.9"}, 0, 1},
+		{"written differently", []string{"-n=home", "-type=AAAA"}, []dnsimple.Record{dnsimple.NewRecord("home", "AAAA", "2001:0db8::0009", 60)}, []string{"2001:db8::9"}, 1, 0},
+		{"new TTL", []string{"-n=home", "-ttl=300"}, []dnsimple.Record{dnsimple.NewRecord("home", "A", "203.0.113.9", 60)}, []string{"203.0.113.9"}, 0, 1},
+		{"same TTL", []string{"-n=home", "-ttl=60"}, []dnsimple.Record{dnsimple.NewRecord("home", "A", "203.0.113.9", 60)}, []string{"203.0.113.9"}, 1, 0},
+		{"multiple", []string{"-n=home", "-allow-multiple"}, []dnsimple.Record{
+			dnsimple.NewRecord("home", "A", "203.0.113.9", 60),
+			dnsimple.NewRecord("home", "A", "203.0.113.8", 60),
+		}, []string{"203.0.113.9"}, 1, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := dnsimpletest.NewServer()
+			defer srv.Close()
+			for _, rec := range test.existing {
+				srv.Add("example.com", rec)
+			}
+			testSetup(t, srv, test.args...)
+			before := count(skips, skipUnchanged)
+			for _, ip := range test.ips {
+				*forceIP = ip
+				if err := runOnce(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if n := count(skips, skipUnchanged) - before; n != test.wantSkips {
+				t.Errorf("Skipped %d updates as unchanged, expected %d", n, test.wantSkips)
+			}
+			if n := len(srv.Writes()); n != test.wantWrites {
+				t.Errorf("Sent %d writes, expected %d", n, test.wantWrites)
+			}
+		})
+	}
+}
+
+// count returns the value of c for label so far.
+func count(c *Counter, label string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[label]
+}
+
+// TestMaxRecordAge rewrites a record of -n that is up to date once it was
+// last written longer than -max-record-age ago.
+func TestMaxRecordAge(t *testing.T) {
+	tests := []struct {
+		updated    time.Duration
+		wantWrites int
+	}{
+		{time.Minute, 0},
+		{2 * time.Hour, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.updated.String(), func(t *testing.T) {
+			srv := dnsimpletest.NewServer()
+			defer srv.Close()
+			rec := dnsimple.NewRecord("home", "A", "203.0.113.9", 60)
+			rec.Record.Updated = time.Now().Add(-test.updated).UTC().Format(time.RFC3339)
+			srv.Add("example.com", rec)
+			testSetup(t, srv, "-n=home", "-max-record-age=1h", "-force-ip=203.0.113.9")
+			if err := runOnce(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if n := len(srv.Writes()); n != test.wantWrites {
+				t.Errorf("Sent %d writes, expected %d", n, test.wantWrites)
+			}
+		})
+	}
+}
+
+// TestDryRunAgrees plans updates of -n as -dry-run does, makes them and
+// checks that exactly the planned records were written.
+func TestDryRunAgrees(t *testing.T) {
+	home := func(ip string) dnsimple.Record {
+		return dnsimple.NewRecord("home", "A", ip, 60)
+	}
+	tests := []struct {
+		name     string
+		args     []string
+		existing []dnsimple.Record
+		// want are the writes, as method and record ID
+		want    []string
+		wantErr bool
+	}{
+		{"create", nil, nil, []string{"POST"}, false},
+		{"unchanged", nil, []dnsimple.Record{home("203.0.113.9")}, nil, false},
+		{"update", nil, []dnsimple.Record{home("203.0.113.8")}, []string{"PUT 1"}, false},
+		{"other name and type", nil, []dnsimple.Record{
+			dnsimple.NewRecord("home", "TXT", "text", 60),
+			dnsimple.NewRecord("work", "A", "203.0.113.8", 60),
+			home("203.0.113.8"),
+		}, []string{"PUT 3"}, false},
+		{"filter", []string{"-filter=name==home && content!=192.0.2.1"}, []dnsimple.Record{home("192.0.2.1"), home("203.0.113.8")}, []string{"PUT 2"}, false},
+		{"multiple", nil, []dnsimple.Record{home("203.0.113.7"), home("203.0.113.8")}, nil, false},
+		{"allow multiple", []string{"-allow-multiple"}, []dnsimple.Record{home("203.0.113.9"), home("192.0.2.1"), home("192.0.2.2")}, []string{"PUT 2", "PUT 3"}, false},
+		{"max records", []string{"-allow-multiple", "-max-records=1"}, []dnsimple.Record{home("192.0.2.1"), home("192.0.2.2")}, nil, true},
+		{"threshold", []string{"-ip-change-threshold=24"}, []dnsimple.Record{home("203.0.113.8")}, nil, false},
+		{"outside threshold", []string{"-ip-change-threshold=24"}, []dnsimple.Record{home("192.0.2.1")}, []string{"PUT 1"}, false},
+		{"new TTL", []string{"-ttl=300"}, []dnsimple.Record{home("203.0.113.9")}, []string{"PUT 1"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := dnsimpletest.NewServer()
+			defer srv.Close()
+			for _, rec := range test.existing {
+				srv.Add("example.com", rec)
+			}
+			testSetup(t, srv, append([]string{"-n=home", "-force-ip=203.0.113.9"}, test.args...)...)
+
+			_, plans, err := planAll(context.Background())
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Planning failed with %v", err)
+			}
+			var planned []string
+			for _, c := range plans["example.com"] {
+				switch c.Action {
+				case actionCreate:
+					planned = append(planned, "POST")
+				case actionUpdate, actionRefresh:
+					planned = append(planned, fmt.Sprintf("PUT %d", c.Old.Record.ID))
+				}
+			}
+
+			if err := runOnce(context.Background()); (err != nil) != test.wantErr {
+				t.Fatalf("Update failed with %v", err)
+			}
+			var written []string
+			for _, r := range srv.Writes() {
+				w := r.Method
+				if r.Method != "POST" {
+					w += " " + r.Path[strings.LastIndex(r.Path, "/")+1:]
+				}
+				written = append(written, w)
+			}
+			sort.Strings(planned)
+			sort.Strings(written)
+
+			if strings.Join(planned, ", ") != strings.Join(written, ", ") {
+				t.Errorf("Dry run planned [%s], update wrote [%s]", strings.Join(planned, ", "), strings.Join(written, ", "))
+			}
+			if strings.Join(written, ", ") != strings.Join(test.want, ", ") {
+				t.Errorf("Update wrote [%s], expected [%s]", strings.Join(written, ", "), strings.Join(test.want, ", "))
+			}
+		})
+	}
+}
+
+// eventRecorder keeps the events it is notified of.
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *eventRecorder) Notify(ctx context.Context, e Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e.String())
+	return nil
+}
+
+// TestIPChangedEvents checks that every address record written with a
+// new IP is notified of, whether it is the record of -n or one of
+// -content.
+func TestIPChangedEvents(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		existing []dnsimple.Record
+		want     []string
+	}{
+		{"create", []string{"-n=home"}, nil, []string{"Created A record home.example.com with 203.0.113.9"}},
+		{"update", []string{"-n=home"}, []dnsimple.Record{dnsimple.NewRecord("home", "A", "203.0.113.8", 60)}, []string{"Changed A record home.example.com from 203.0.113.8 to 203.0.113.9"}},
+		{"unchanged", []string{"-n=home"}, []dnsimple.Record{dnsimple.NewRecord("home", "A", "203.0.113.9", 60)}, nil},
+		{"content create", []string{"-n=home", "-content=@auto"}, nil, []string{"Created A record home.example.com with 203.0.113.9"}},
+		{"content update", []string{"-n=home", "-content=@auto"}, []dnsimple.Record{dnsimple.NewRecord("home", "A", "203.0.113.8", 60)}, []string{"Changed A record home.example.com from 203.0.113.8 to 203.0.113.9"}},
+		{"content TXT", []string{"-n=home", "-type=TXT", "-content=@auto"}, nil, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := dnsimpletest.NewServer()
+			defer srv.Close()
+			for _, rec := range test.existing {
+				srv.Add("example.com", rec)
+			}
+			testSetup(t, srv, append([]string{"-force-ip=203.0.113.9"}, test.args...)...)
+			rec := &eventRecorder{}
+			notifier = rec
+
+			if err := runOnce(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			notifications.Wait()
+			if strings.Join(rec.events, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("Notified of %q, expected %q", rec.events, test.want)
+			}
+		})
+	}
+}
+
+// TestPublishChanges writes records of -n, -content and a spec with a new
+// IP, and checks that each is published and counted as changed.
+func TestPublishChanges(t *testing.T) {
+	specFile := filepath.Join(t.TempDir(), "spec.json")
+	err := ioutil.WriteFile(specFile, []byte(`{"records": [
+		{"name": "home", "type": "A", "content": "@auto", "ttl": 60},
+		{"name": "www", "type": "CNAME", "content": "home.example.com"}
+	]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"entry", []string{"-n=home"}},
+		{"content", []string{"-n=home", "-content=@auto"}},
+		{"spec", []string{"-spec=" + specFile}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var published []string
+			target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				mu.Lock()
+				published = append(published, r.Method+" "+string(body))
+				mu.Unlock()
+			}))
+			defer target.Close()
+			srv := dnsimpletest.NewServer()
+			defer srv.Close()
+			srv.Add("example.com", dnsimple.NewRecord("home", "A", "203.0.113.8", 60))
+			testSetup(t, srv, append([]string{"-force-ip=203.0.113.9", "-publish-url=" + target.URL, "-publish-body={{.FQDN}} {{.IP}}"}, test.args...)...)
+			before := count(recordUpdates, "ip_changed")
+
+			if err := runOnce(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			notifications.Wait()
+			if want := []string{"PUT home.example.com 203.0.113.9"}; strings.Join(published, "\n") != strings.Join(want, "\n") {
+				t.Errorf("Published %q, expected %q", published, want)
+			}
+			if n := count(recordUpdates, "ip_changed") - before; n != 1 {
+				t.Errorf("Counted %d changed records, expected 1", n)
+			}
+		})
+	}
+}
+
+// TestCanaryReadServer checks the canary against the server it is written
+// to, not a -read-server replica that doesn't have it yet.
+func TestCanaryReadServer(t *testing.T) {
+	srv := dnsimpletest.NewServer()
+	defer srv.Close()
+	replica := dnsimpletest.NewServer()
+	defer replica.Close()
+	testSetup(t, srv, "-n=home", "-force-ip=203.0.113.9", "-canary=_canary", "-read-server="+replica.Host())
+	before := count(canaryChecks, "ok")
+
+	for i := 0; i < 2; i++ {
+		if err := runOnce(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := count(canaryChecks, "ok") - before; n != 2 {
+		t.Errorf("%d of 2 canary checks succeeded", n)
+	}
+}
+
+// TestPublishedEntries checks that every record of -n written is waited
+// for with -wait-propagation and notified of, under its own name.
+func TestPublishedEntries(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		existing []dnsimple.Record
+		want     []string
+	}{
+		{"create", nil, nil, []string{"home.example.com"}},
+		{"update", nil, []dnsimple.Record{dnsimple.NewRecord("home", "A", "192.0.2.1", 60)}, []string{"home.example.com"}},
+		{"allow multiple", []string{"-allow-multiple"}, []dnsimple.Record{
+			dnsimple.NewRecord("home", "A", "192.0.2.1", 60),
+			dnsimple.NewRecord("home", "A", "192.0.2.2", 60),
+		}, []string{"home.example.com", "home.example.com"}},
+		{"filter", []string{"-filter=name==vpn"}, []dnsimple.Record{dnsimple.NewRecord("vpn", "A", "192.0.2.1", 60)}, []string{"vpn.example.com"}},
+		{"filter multiple", []string{"-filter=name==home || name==vpn", "-allow-multiple"}, []dnsimple.Record{
+			dnsimple.NewRecord("home", "A", "192.0.2.1", 60),
+			dnsimple.NewRecord("vpn", "A", "192.0.2.2", 60),
+		}, []string{"home.example.com", "vpn.example.com"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := dnsimpletest.NewServer()
+			defer srv.Close()
+			for _, rec := range test.existing {
+				srv.Add("example.com", rec)
+			}
+			testSetup(t, srv, append([]string{"-n=home", "-wait-propagation=1m"}, test.args...)...)
+			events := &eventRecorder{}
+			notifier = events
+
+			// Not through runOnce, which would wait on the real name servers
+			if err := updateEntry(context.Background(), "203.0.113.9"); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, r := range written {
+				got = append(got, r.name)
+			}
+			if strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Errorf("Waiting for %q, expected %q", got, test.want)
+			}
+			notifications.Wait()
+			got = nil
+			for _, e := range events.events {
+				// The FQDN is the fourth word of "Changed A record home.example.com from ..."
+				got = append(got, strings.Fields(e)[3])
+			}
+			sort.Strings(got)
+			if strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Errorf("Notified of %q, expected %q", events.events, test.want)
+			}
+		})
+	}
+}
+
+// TestSingleProviderFailures checks that failed lookups are counted when
+// there is no other provider to fall back to.
+func TestSingleProviderFailures(t *testing.T) {
+	srv := dnsimpletest.NewServer()
+	defer srv.Close()
+	testSetup(t, srv, "-n=home", "-ip-file="+filepath.Join(t.TempDir(), "missing"))
+	p := providersFor(4)[0].String()
+	before := count(providerFailures, p)
+
+	for i := 0; i < 2; i++ {
+		if _, err := lookupIP(context.Background(), 4); err == nil {
+			t.Fatal("Lookup from a missing file succeeded")
+		}
+	}
+	if n := count(providerFailures, p) - before; n != 2 {
+		t.Errorf("Counted %d failures of %s, expected 2", n, p)
+	}
+}
+
+// TestSummaryIP checks that the summary only shows addresses that are
+// published.
+func TestSummaryIP(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-force-ip=203.0.113.9"}, "203.0.113.9"},
+		{[]string{"-force-ip=10.0.0.1"}, ""},
+		{[]string{"-force-ip=127.0.0.1"}, ""},
+		{[]string{"-force-ip=10.0.0.1", "-reject-private=false"}, "10.0.0.1"},
+		{[]string{"-force-ip=10.0.0.1", "-ip-map=10.0.0.1=203.0.113.1"}, "203.0.113.1"},
+		{[]string{"-force-ip=203.0.113.1", "-ip-map=203.0.113.1=10.0.0.1"}, ""},
+	}
+	for _, test := range tests {
+		t.Run(strings.Join(test.args, " "), func(t *testing.T) {
+			srv := dnsimpletest.NewServer()
+			defer srv.Close()
+			testSetup(t, srv, append([]string{"-n=home"}, test.args...)...)
+			if _, err := detectIP(context.Background(), 4); err != nil {
+				t.Fatal(err)
+			}
+			if summary.ip != test.want {
+				t.Errorf("Summary shows %q, expected %q", summary.ip, test.want)
+			}
+		})
+	}
+}
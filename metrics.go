@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metric is anything that can write itself in the Prometheus text format.
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+var (
+	metricsMu sync.Mutex
+	registry  []metric
+)
+
+func register(m metric) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	registry = append(registry, m)
+}
+
+// serveMetrics writes all registered metrics in the Prometheus text
+// exposition format.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	for _, m := range registry {
+		m.writeTo(w)
+	}
+}
+
+// labelString formats a single label pair, or nothing if label is unset.
+func labelString(label, value string, extra ...string) string {
+	var pairs []string
+	if label != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", label, value))
+	}
+	pairs = append(pairs, extra...)
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Histogram counts observations in cumulative buckets. It can be split by
+// a single label.
+type Histogram struct {
+	name, help, label string
+	buckets           []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewHistogram(name, help, label string, buckets []float64) *Histogram {
+	h := &Histogram{
+		name:    name,
+		help:    help,
+		label:   label,
+		buckets: buckets,
+		series:  map[string]*histogramSeries{},
+	}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(labelValue string, v float64) {
+	statsd.Timing(h.name, labelValue, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[labelValue]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[labelValue] = s
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *Histogram) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	values := make([]string, 0, len(h.series))
+	for v := range h.series {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	for _, v := range values {
+		s := h.series[v]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.label, v, fmt.Sprintf("le=\"%g\"", b)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.label, v, `le="+Inf"`), s.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", h.name, labelString(h.label, v), s.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelString(h.label, v), s.count)
+	}
+}
+
+// Counter counts events. It can be split by a single label.
+type Counter struct {
+	name, help, label string
+
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+func NewCounter(name, help, label string) *Counter {
+	c := &Counter{
+		name:   name,
+		help:   help,
+		label:  label,
+		counts: map[string]uint64{},
+	}
+	register(c)
+	return c
+}
+
+func (c *Counter) Inc(labelValue string) {
+	statsd.Count(c.name, labelValue, 1)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[labelValue]++
+}
+
+func (c *Counter) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	values := make([]string, 0, len(c.counts))
+	for v := range c.counts {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	for _, v := range values {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, labelString(c.label, v), c.counts[v])
+	}
+}
+
+// ipLookupDuration tracks how long each IP provider takes to answer.
+var ipLookupDuration = NewHistogram(
+	"dnsimple_ip_lookup_duration_seconds",
+	"Time taken to look up the external IP.",
+	"provider",
+	[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+)
+
+// providerFailures counts failed IP lookups by provider.
+var providerFailures = NewCounter(
+	"dnsimple_ip_lookup_failures_total",
+	"Failed IP lookups, by provider.",
+	"provider",
+)
+
+// updateDuration tracks how long whole updates take.
+var updateDuration = NewHistogram(
+	"dnsimple_update_duration_seconds",
+	"Time taken by an update, from the IP lookup to the last API request.",
+	"",
+	[]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+)
+
+// updateResults counts updates by whether they succeeded.
+var updateResults = NewCounter(
+	"dnsimple_updates_total",
+	"Updates run, by result.",
+	"result",
+)
+
+// skips counts updates that were deliberately not made, by the reason
+// logSkip was given.
+var skips = NewCounter(
+	"dnsimple_skip_total",
+	"Updates deliberately not made, by reason.",
+	"reason",
+)
+
+// recordUpdates counts successful record updates by whether the content
+// changed (ip_changed) or was written again as it was (ip_refreshed).
+var recordUpdates = NewCounter(
+	"dnsimple_record_updates_total",
+	"Records updated, by whether their content changed.",
+	"change",
+)
+
+// canaryChecks counts -canary checks by whether the canary held the value
+// written (ok), didn't (diverged) or couldn't be checked (error).
+var canaryChecks = NewCounter(
+	"dnsimple_canary_checks_total",
+	"Canary checks run, by result.",
+	"result",
+)
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// sameContent reports whether a and b are the same content for records of
+// type typ, even if written differently.
+func sameContent(typ, a, b string) bool {
+	return a == b || normalizeContent(typ, a) == normalizeContent(typ, b)
+}
+
+// normalizeContent returns content of a record of type typ in a canonical
+// form: addresses as net.IP prints them, host names in lower case without
+// the trailing dot and TXT contents without their quoting. Content that
+// can't be parsed is returned as it is.
+func normalizeContent(typ, content string) string {
+	switch typ {
+	case "A", "AAAA":
+		if ip := net.ParseIP(strings.TrimSpace(content)); ip != nil {
+			return ip.String()
+		}
+	case "ALIAS", "CNAME":
+		return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(content)), ".")
+	case "TXT":
+		if text, ok := unquoteTXT(content); ok {
+			return text
+		}
+	}
+	return content
+}
+
+// unquoteTXT joins the character strings of a TXT record given in zone
+// file syntax, like "v=spf1 " "-all", into one. Content that isn't quoted
+// throughout is reported as not ok.
+func unquoteTXT(content string) (string, bool) {
+	s := strings.TrimSpace(content)
+	if !strings.HasPrefix(s, `"`) {
+		return "", false
+	}
+	var b strings.Builder
+	for s != "" {
+		if s[0] != '"' {
+			return "", false
+		}
+		i := 1
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+			}
+			b.WriteByte(s[i])
+		}
+		if i == len(s) {
+			return "", false
+		}
+		s = strings.TrimLeft(s[i+1:], " \t")
+	}
+	return b.String(), true
+}
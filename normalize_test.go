@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestNormalizeContent(t *testing.T) {
+	tests := []struct {
+		typ, content, want string
+	}{
+		{"A", "203.0.113.9", "203.0.113.9"},
+		{"A", " 203.0.113.9\n", "203.0.113.9"},
+		{"A", "not an address", "not an address"},
+		{"AAAA", "2001:db8::9", "2001:db8::9"},
+		{"AAAA", "2001:0db8:0000:0000:0000:0000:0000:0009", "2001:db8::9"},
+		{"AAAA", "2001:DB8::9", "2001:db8::9"},
+		{"AAAA", "::ffff:203.0.113.9", "203.0.113.9"},
+		{"CNAME", "Home.Example.COM.", "home.example.com"},
+		{"CNAME", "home.example.com", "home.example.com"},
+		{"ALIAS", "example.net.", "example.net"},
+		{"TXT", "v=spf1 -all", "v=spf1 -all"},
+		{"TXT", `"v=spf1 -all"`, "v=spf1 -all"},
+		{"TXT", `"v=spf1 " "-all"`, "v=spf1 -all"},
+		{"TXT", `"say \"hi\""`, `say "hi"`},
+		{"TXT", `"unterminated`, `"unterminated`},
+		{"TXT", `"quoted" and not`, `"quoted" and not`},
+		{"MX", "Mail.Example.com.", "Mail.Example.com."},
+	}
+	for _, test := range tests {
+		if got := normalizeContent(test.typ, test.content); got != test.want {
+			t.Errorf("normalizeContent(%q, %q) = %q, expected %q", test.typ, test.content, got, test.want)
+		}
+	}
+}
+
+func TestSameContent(t *testing.T) {
+	tests := []struct {
+		typ, a, b string
+		want      bool
+	}{
+		{"A", "203.0.113.9", "203.0.113.9", true},
+		{"A", "203.0.113.9", "203.0.113.10", false},
+		{"AAAA", "2001:db8::9", "2001:0db8::0009", true},
+		{"AAAA", "2001:db8::9", "2001:db8::10", false},
+		{"CNAME", "home.example.com.", "HOME.example.com", true},
+		{"CNAME", "home.example.com", "work.example.com", false},
+		{"TXT", `"v=spf1 " "-all"`, "v=spf1 -all", true},
+		{"TXT", "v=spf1 -all", "v=spf1 ~all", false},
+		// Other types are compared as they are written
+		{"MX", "mail.example.com.", "mail.example.com", false},
+	}
+	for _, test := range tests {
+		if got := sameContent(test.typ, test.a, test.b); got != test.want {
+			t.Errorf("sameContent(%q, %q, %q) = %t, expected %t", test.typ, test.a, test.b, got, test.want)
+		}
+	}
+}
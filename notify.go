@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// notifyTimeout limits the delivery of a single event to a notifier.
+const notifyTimeout = 10 * time.Second
+
+// Kinds of events sent to notifiers.
+const (
+	EventIPChanged    = "ip_changed"
+	EventUpdateFailed = "update_failed"
+	EventStartup      = "startup"
+	EventShutdown     = "shutdown"
+	EventCanaryFailed = "canary_failed"
+)
+
+// Event is something that happened to the updater, sent to the
+// notifiers. Which fields are set depends on the kind.
+type Event struct {
+	Kind string    `json:"event"`
+	Time time.Time `json:"time"`
+	Host string    `json:"host,omitempty"`
+	// Set for EventIPChanged and, without the IPs, EventCanaryFailed
+	Domain string `json:"domain,omitempty"`
+	Name   string `json:"name,omitempty"`
+	FQDN   string `json:"fqdn,omitempty"`
+	Type   string `json:"type,omitempty"`
+	ID     int    `json:"id,omitempty"`
+	OldIP  string `json:"old_ip,omitempty"`
+	NewIP  string `json:"new_ip,omitempty"`
+	// Set for EventUpdateFailed and EventCanaryFailed
+	Error string `json:"error,omitempty"`
+}
+
+// String describes e in a sentence.
+func (e Event) String() string {
+	switch e.Kind {
+	case EventIPChanged:
+		if e.OldIP == "" {
+			return fmt.Sprintf("Created %s record %s with %s", e.Type, e.FQDN, e.NewIP)
+		}
+		return fmt.Sprintf("Changed %s record %s from %s to %s", e.Type, e.FQDN, e.OldIP, e.NewIP)
+	case EventUpdateFailed:
+		return fmt.Sprintf("Update failed on %s: %s", e.Host, e.Error)
+	case EventStartup:
+		return fmt.Sprintf("dnsimple-updater %s started on %s", version, e.Host)
+	case EventShutdown:
+		return fmt.Sprintf("dnsimple-updater stopped on %s", e.Host)
+	case EventCanaryFailed:
+		return fmt.Sprintf("Canary check of %s failed on %s: %s", e.FQDN, e.Host, e.Error)
+	}
+	return e.Kind
+}
+
+// Notifier passes events on to somewhere outside the updater.
+type Notifier interface {
+	Notify(ctx context.Context, e Event) error
+}
+
+// MultiNotifier sends each event to all of its notifiers.
+type MultiNotifier []Notifier
+
+func (m MultiNotifier) Notify(ctx context.Context, e Event) error {
+	var errs []string
+	for _, n := range m {
+		if err := n.Notify(ctx, e); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// WebhookNotifier posts events as JSON to URL. With a Secret, the body is
+// signed in the X-Signature header (see signPayload).
+type WebhookNotifier struct {
+	URL    string
+	Secret string
+}
+
+func (w *WebhookNotifier) Notify(ctx context.Context, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	header := http.Header{"Content-Type": {"application/json"}}
+	if w.Secret != "" {
+		header.Set("X-Signature", signPayload(w.Secret, body))
+	}
+	return post(ctx, w.URL, header, body)
+}
+
+// SlackNotifier posts events as messages to a Slack incoming webhook.
+type SlackNotifier struct {
+	URL string
+}
+
+func (s *SlackNotifier) Notify(ctx context.Context, e Event) error {
+	body, err := json.Marshal(map[string]string{"text": e.String()})
+	if err != nil {
+		return err
+	}
+	return post(ctx, s.URL, http.Header{"Content-Type": {"application/json"}}, body)
+}
+
+// ExecNotifier runs Command with the shell for each event. The event is
+// passed as JSON on stdin and in DNSIMPLE_* environment variables.
+type ExecNotifier struct {
+	Command string
+}
+
+func (x *ExecNotifier) Notify(ctx context.Context, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", x.Command)
+	cmd.Stdin = bytes.NewReader(body)
+	id := ""
+	if e.ID != 0 {
+		id = strconv.Itoa(e.ID)
+	}
+	cmd.Env = append(os.Environ(),
+		"DNSIMPLE_EVENT="+e.Kind,
+		"DNSIMPLE_MESSAGE="+e.String(),
+		"DNSIMPLE_FQDN="+e.FQDN,
+		"DNSIMPLE_TYPE="+e.Type,
+		"DNSIMPLE_RECORD_ID="+id,
+		"DNSIMPLE_OLD_IP="+e.OldIP,
+		"DNSIMPLE_NEW_IP="+e.NewIP,
+		"DNSIMPLE_ERROR="+e.Error,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// PublishNotifier sends the new IP of each EventIPChanged to another
+// system, such as a service discovery endpoint, with an HTTP request of
+// Method to URL. The body is Body executed against a publishContext.
+// Other events are ignored.
+type PublishNotifier struct {
+	URL    string
+	Method string
+	Body   *template.Template
+}
+
+// publishContext is what the body of a PublishNotifier is executed
+// against: the event, with its new IP also as IP.
+type publishContext struct {
+	Event
+	IP string
+}
+
+func (p *PublishNotifier) Notify(ctx context.Context, e Event) error {
+	if e.Kind != EventIPChanged {
+		return nil
+	}
+	var body bytes.Buffer
+	if err := p.Body.Execute(&body, publishContext{e, e.NewIP}); err != nil {
+		return err
+	}
+	return send(ctx, p.Method, p.URL, nil, body.Bytes())
+}
+
+// newPublishNotifier returns a PublishNotifier for -publish-url, trying
+// out the body template on an example event.
+func newPublishNotifier(rawurl, method, body string) (*PublishNotifier, error) {
+	tmpl, err := template.New("publish-body").Option("missingkey=error").Parse(body)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid -publish-body: %s", err)
+	}
+	example := Event{Kind: EventIPChanged, FQDN: "home.example.com", OldIP: "192.0.2.1", NewIP: "192.0.2.2"}
+	if err := tmpl.Execute(ioutil.Discard, publishContext{example, example.NewIP}); err != nil {
+		return nil, fmt.Errorf("Invalid -publish-body: %s", err)
+	}
+	return &PublishNotifier{URL: rawurl, Method: strings.ToUpper(method), Body: tmpl}, nil
+}
+
+// notifier receives the events if any notifiers are configured.
+var notifier Notifier
+
+// notifications tracks deliveries in progress so they can be waited for
+// before exiting.
+var notifications sync.WaitGroup
+
+// newNotifier builds the notifiers given by the flags, or returns nil if
+// there are none.
+func newNotifier() (Notifier, error) {
+	var m MultiNotifier
+	for name, rawurl := range map[string]string{"-webhook": *webhookURL, "-slack-webhook": *slackWebhook, "-publish-url": *publishURL} {
+		if rawurl == "" {
+			continue
+		}
+		u, err := url.Parse(rawurl)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("Invalid %s, expected an http or https URL", name)
+		}
+	}
+	if *webhookURL != "" {
+		m = append(m, &WebhookNotifier{URL: *webhookURL, Secret: *webhookSecret})
+	}
+	if *slackWebhook != "" {
+		m = append(m, &SlackNotifier{URL: *slackWebhook})
+	}
+	if *notifyExec != "" {
+		m = append(m, &ExecNotifier{Command: *notifyExec})
+	}
+	if *publishURL != "" {
+		p, err := newPublishNotifier(*publishURL, *publishMethod, *publishBody)
+		if err != nil {
+			return nil, err
+		}
+		m = append(m, p)
+	}
+	if len(m) == 0 {
+		return nil, nil
+	}
+	return m, nil
+}
+
+// notify sends e to the notifiers in the background. Failed deliveries
+// are logged and not retried.
+func notify(e Event) {
+	if notifier == nil {
+		return
+	}
+	e.Time = time.Now().UTC()
+	e.Host, _ = os.Hostname()
+	n := notifier
+	notifications.Add(1)
+	go func() {
+		defer notifications.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		defer cancel()
+		if err := n.Notify(ctx, e); err != nil {
+			logWarn("Could not deliver %s notification: %s", e.Kind, err)
+			return
+		}
+		logDebug("Delivered %s notification", e.Kind)
+	}()
+}
+
+// notifyIPChange sends an EventIPChanged for record id, named name in
+// domain and of type typ, unless its IP stayed the same.
+func notifyIPChange(domain, name, typ string, id int, oldIP, newIP string) {
+	if oldIP == newIP {
+		return
+	}
+	notify(Event{
+		Kind:   EventIPChanged,
+		Domain: domain,
+		Name:   name,
+		FQDN:   recordFQDN(name, domain),
+		Type:   typ,
+		ID:     id,
+		OldIP:  oldIP,
+		NewIP:  newIP,
+	})
+}
+
+// post posts body to rawurl, expecting a 2xx answer.
+func post(ctx context.Context, rawurl string, header http.Header, body []byte) error {
+	return send(ctx, "POST", rawurl, header, body)
+}
+
+// send makes a request of method with body to rawurl, expecting a 2xx
+// answer. Errors only name the host, as the rest of the URL may hold a
+// token, as Slack webhooks do.
+func send(ctx context.Context, method, rawurl string, header http.Header, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, method, rawurl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if header != nil {
+		req.Header = header
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		}
+		return fmt.Errorf("%s: %s", req.URL.Host, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s answered with %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
+
+// signPayload returns the X-Signature header for body: "sha256=" followed
+// by the hex encoded HMAC-SHA256 of the exact body bytes, keyed with
+// secret.
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
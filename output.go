@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// writeOutput prints the results of a command in the format chosen by
+// -output: v as JSON, or header and rows as CSV or an aligned table.
+func writeOutput(v interface{}, header []string, rows [][]string) error {
+	switch *outputFormat {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write(header)
+		w.WriteAll(rows)
+		return w.Error()
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, strings.ToUpper(strings.Join(header, "\t")))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+// list prints the records of every managed domain.
+func list(ctx context.Context) error {
+	domains := []string{*domainName}
+	if spec != nil {
+		domains = domains[:0]
+		for domain := range spec.byDomain() {
+			domains = append(domains, domain)
+		}
+		sort.Strings(domains)
+	}
+
+	var recs []interface{}
+	var rows [][]string
+	for _, domain := range domains {
+		batch, err := listRecords(ctx, domain)
+		if err != nil {
+			return fmt.Errorf("Could not list records of %s: %s", domain, err)
+		}
+		for _, r := range batch {
+			recs = append(recs, r.Record)
+			rows = append(rows, []string{
+				domain,
+				strconv.Itoa(r.Record.ID),
+				r.Record.Name,
+				r.Record.Type,
+				strconv.Itoa(r.Record.TTL),
+				strconv.Itoa(r.Record.Priority),
+				r.Record.Content,
+			})
+		}
+	}
+	if recs == nil {
+		recs = []interface{}{}
+	}
+	return writeOutput(recs, []string{"domain", "id", "name", "type", "ttl", "prio", "content"}, rows)
+}
+
+// listDomains prints the domains the token has access to.
+func listDomains(ctx context.Context) error {
+	c, err := api(ctx, "")
+	if err != nil {
+		return err
+	}
+	domains, err := c.ListDomains(ctx)
+	if err != nil {
+		return fmt.Errorf("Could not list domains: %s", err)
+	}
+	var rows [][]string
+	for _, d := range domains {
+		rows = append(rows, []string{strconv.Itoa(d.ID), d.Name, d.UnicodeName, d.State})
+	}
+	return writeOutput(domains, []string{"id", "name", "unicode_name", "state"}, rows)
+}
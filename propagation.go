@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// liveRecord is a record that was written and should show up in DNS.
+type liveRecord struct {
+	domain, name, typ, content string
+}
+
+// written holds the records written by the current update, for
+// -wait-propagation.
+var (
+	writtenMu sync.Mutex
+	written   []liveRecord
+)
+
+// published notes that the record name of domain now holds content.
+func published(domain, name, typ, content string) {
+	if !canResolve(typ) {
+		return
+	}
+	fqdn := recordFQDN(name, domain)
+	comparePropagation(fqdn, typ, content)
+	if *waitPropagation > 0 {
+		writtenMu.Lock()
+		written = append(written, liveRecord{domain, fqdn, typ, content})
+		writtenMu.Unlock()
+	}
+}
+
+// canResolve reports whether records of type typ can be looked up to
+// compare them with what was written.
+func canResolve(typ string) bool {
+	return typ == "A" || typ == "AAAA" || typ == "CNAME" || typ == "TXT"
+}
+
+// comparePropagation looks up name of type typ in DNS after an update
+// and logs whether the answer already is content. It runs in the
+// background and never fails the update.
+func comparePropagation(name, typ, content string) {
+	if !*compareWithDNS {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		answers, err := resolve(ctx, *compareResolver, name, typ)
+		where := "DNS"
+		if *compareResolver != "" {
+			where = *compareResolver
+		}
+		switch {
+		case err != nil:
+			logInfo("Could not look up %s record %s in %s: %s", typ, name, where, err)
+		case containsFold(answers, content):
+			logInfo("%s already resolves %s record %s to %s", where, typ, name, content)
+		default:
+			logInfo("%s still resolves %s record %s to %s, not %s yet", where, typ, name, strings.Join(answers, ", "), content)
+		}
+	}()
+}
+
+// resolve returns the answers for name of type typ, asking server if
+// set and the system resolver otherwise.
+func resolve(ctx context.Context, server, name, typ string) ([]string, error) {
+	r := net.DefaultResolver
+	if server != "" {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		r = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	switch typ {
+	case "A", "AAAA":
+		network := "ip4"
+		if typ == "AAAA" {
+			network = "ip6"
+		}
+		ips, err := r.LookupIP(ctx, network, name)
+		var answers []string
+		for _, ip := range ips {
+			answers = append(answers, ip.String())
+		}
+		return answers, err
+	case "CNAME":
+		cname, err := r.LookupCNAME(ctx, name)
+		return []string{strings.TrimSuffix(cname, ".")}, err
+	case "TXT":
+		return r.LookupTXT(ctx, name)
+	}
+	return nil, fmt.Errorf("%s records can't be looked up", typ)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(strings.TrimSuffix(v, "."), strings.TrimSuffix(s, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForPropagation polls the authoritative name servers of each of recs
+// until all of them answer with the content that was written, or until
+// -wait-propagation has passed.
+func waitForPropagation(ctx context.Context, recs []liveRecord) error {
+	ctx, cancel := context.WithTimeout(ctx, *waitPropagation)
+	defer cancel()
+
+	for _, rec := range recs {
+		nss, err := net.DefaultResolver.LookupNS(ctx, rec.domain)
+		if err != nil {
+			return fmt.Errorf("Could not find the name servers of %s: %s", rec.domain, err)
+		}
+		for _, ns := range nss {
+			server := strings.TrimSuffix(ns.Host, ".")
+			for {
+				answers, err := resolve(ctx, server, rec.name, rec.typ)
+				if err == nil && containsFold(answers, rec.content) {
+					break
+				}
+				logDebug("Waiting for %s to serve %s record %s with %s", server, rec.typ, rec.name, rec.content)
+				select {
+				case <-ctx.Done():
+					return fmt.Errorf("%s record %s not live on %s after %s", rec.typ, rec.name, server, *waitPropagation)
+				case <-time.After(*waitInterval):
+				}
+			}
+		}
+		logSuccess("%s record %s is live on the name servers of %s", rec.typ, rec.name, rec.domain)
+	}
+	return nil
+}
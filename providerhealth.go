@@ -0,0 +1,91 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/surma-dump/dnsimple-updater/dnsimple"
+)
+
+// providerState is what is known about how an IP provider did lately.
+type providerState struct {
+	// failures counts the lookups that failed in a row
+	failures int
+	// downUntil is when a failed provider is asked in its turn again
+	downUntil time.Time
+	// latency is a moving average of the time successful lookups took
+	latency time.Duration
+}
+
+// ProviderHealth tracks the IP providers by name for -provider-health, so
+// that providers which failed recently are asked only after the others
+// until their cooldown is over.
+type ProviderHealth struct {
+	mu     sync.Mutex
+	states map[string]*providerState
+}
+
+// providerHealth tracks the providers of all families.
+var providerHealth = &ProviderHealth{states: map[string]*providerState{}}
+
+func (h *ProviderHealth) state(name string) *providerState {
+	s, ok := h.states[name]
+	if !ok {
+		s = &providerState{}
+		h.states[name] = s
+	}
+	return s
+}
+
+// Order splits providers into those to ask in their given order and
+// those in their cooldown, to ask only if all others failed. The demoted
+// ones come soonest cooldown end first. Without -provider-health, all
+// providers are healthy.
+func (h *ProviderHealth) Order(providers []dnsimple.IPProvider) (healthy, demoted []dnsimple.IPProvider) {
+	if *providerCool <= 0 {
+		return providers, nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	for _, p := range providers {
+		if now.Before(h.state(p.String()).downUntil) {
+			demoted = append(demoted, p)
+		} else {
+			healthy = append(healthy, p)
+		}
+	}
+	sort.SliceStable(demoted, func(i, j int) bool {
+		return h.state(demoted[i].String()).downUntil.Before(h.state(demoted[j].String()).downUntil)
+	})
+	return healthy, demoted
+}
+
+// Report records the outcome of asking p, which took elapsed. A failure
+// demotes p for -provider-health; a success ends its cooldown.
+func (h *ProviderHealth) Report(p dnsimple.IPProvider, elapsed time.Duration, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.state(p.String())
+	if err != nil {
+		s.failures++
+		providerFailures.Inc(p.String())
+		if *providerCool > 0 {
+			s.downUntil = time.Now().Add(*providerCool)
+			logWarn("IP provider %s failed (%d in a row), asking it last for %s", p, s.failures, *providerCool)
+		}
+		return
+	}
+	if s.failures > 0 && *providerCool > 0 {
+		logInfo("IP provider %s answers again after %d failures", p, s.failures)
+	}
+	s.failures = 0
+	s.downUntil = time.Time{}
+	if s.latency == 0 {
+		s.latency = elapsed
+	} else {
+		s.latency = (3*s.latency + elapsed) / 4
+	}
+	logDebug("IP provider %s takes %s on average", p, s.latency)
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/http"
+
+	"golang.org/x/time/rate"
+)
+
+// limitedTransport makes every request wait for a rate.Limiter.
+type limitedTransport struct {
+	next    http.RoundTripper
+	limiter *rate.Limiter
+}
+
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter.Wait(req.Context()); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
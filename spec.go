@@ -0,0 +1,523 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// autoContent in a spec entry's content is replaced with the external IP.
+const autoContent = "@auto"
+
+// SpecRecord is a record as it should exist in the zone.
+type SpecRecord struct {
+	Domain  string `json:"domain,omitempty"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl,omitempty"`
+	// Priority is only used by SRV records.
+	Priority int `json:"prio,omitempty"`
+}
+
+// SpecDomain holds settings for one of the domains in a spec.
+type SpecDomain struct {
+	Token string `json:"token"`
+}
+
+// Spec describes the desired state of the records in one or more zones.
+// Records without a domain belong to -d, domains without a token use -t.
+type Spec struct {
+	Domains map[string]SpecDomain `json:"domains,omitempty"`
+	Records []SpecRecord          `json:"records"`
+}
+
+func loadSpec(path string) (*Spec, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	spec := &Spec{}
+	if err := json.NewDecoder(f).Decode(spec); err != nil {
+		return nil, fmt.Errorf("Could not parse %s: %s", path, err)
+	}
+	domains := map[string]SpecDomain{}
+	for name, d := range spec.Domains {
+		ascii, err := toASCII(name)
+		if err != nil {
+			return nil, fmt.Errorf("Domain %q in %s: %s", name, path, err)
+		}
+		domains[ascii] = d
+	}
+	spec.Domains = domains
+	for i := range spec.Records {
+		r := &spec.Records[i]
+		if r.Domain, err = toASCII(r.Domain); err != nil {
+			return nil, fmt.Errorf("Record %d in %s: %s", i, path, err)
+		}
+		if r.Name, err = toASCII(r.Name); err != nil {
+			return nil, fmt.Errorf("Record %d in %s: %s", i, path, err)
+		}
+		domain := r.Domain
+		if domain == "" {
+			domain = *domainName
+		}
+		if r.Name, err = relativeName(r.Name, domain); err != nil {
+			return nil, fmt.Errorf("Record %d in %s: %s", i, path, err)
+		}
+		r.Type = strings.ToUpper(r.Type)
+		if r.Type == "" || r.Content == "" {
+			return nil, fmt.Errorf("Record %d in %s needs a type and content", i, path)
+		}
+		if r.Content == autoContent && r.Type != "A" && r.Type != "AAAA" {
+			return nil, fmt.Errorf("Record %d in %s: %s is only valid for A and AAAA records", i, path, autoContent)
+		}
+		if r.Type == "ALIAS" {
+			if r.Content, err = checkHostname(r.Content); err != nil {
+				return nil, fmt.Errorf("Record %d in %s: %s", i, path, err)
+			}
+		}
+		if r.Type == "SRV" {
+			if err := checkSRV(r.Content); err != nil {
+				return nil, fmt.Errorf("Record %d in %s: %s", i, path, err)
+			}
+			if err := checkUint16("prio", r.Priority); err != nil {
+				return nil, fmt.Errorf("Record %d in %s: %s", i, path, err)
+			}
+		}
+	}
+	return spec, nil
+}
+
+// byDomain groups the records of the spec by their domain.
+func (s *Spec) byDomain() map[string][]SpecRecord {
+	domains := map[string][]SpecRecord{}
+	for _, r := range s.Records {
+		domain := r.Domain
+		if domain == "" {
+			domain = *domainName
+		}
+		domains[domain] = append(domains[domain], r)
+	}
+	return domains
+}
+
+// token returns the token for domain given in the spec, falling back to
+// -t. It can be called on a nil spec.
+func (s *Spec) token(domain string) string {
+	if s != nil {
+		if d, ok := s.Domains[domain]; ok && d.Token != "" {
+			return d.Token
+		}
+	}
+	return defaultToken()
+}
+
+// validate makes sure there is a domain and token for every record.
+func (s *Spec) validate() error {
+	for domain := range s.byDomain() {
+		if domain == "" {
+			return fmt.Errorf("Records without a domain need -d to be set")
+		}
+		if s.token(domain) == "" {
+			return fmt.Errorf("No token for %s: set -t or add it to the spec's domains", domain)
+		}
+	}
+	return nil
+}
+
+// managedTypes returns the set of record types that appear in recs.
+func managedTypes(recs []SpecRecord) map[string]bool {
+	types := map[string]bool{}
+	for _, r := range recs {
+		types[r.Type] = true
+	}
+	return types
+}
+
+// detectIPs looks up the external IP for every type of record in recs
+// that has autoContent or a template as content. The result maps the record type to the IP, which
+// is missing if it can't be used.
+func detectIPs(ctx context.Context, recs []SpecRecord) (map[string]string, error) {
+	ips := map[string]string{}
+	for _, r := range recs {
+		if r.Content != autoContent && !isTemplate(r.Content) {
+			continue
+		}
+		if _, ok := ips[r.Type]; ok {
+			continue
+		}
+		ip, err := detectIP(ctx, familyOf(r.Type))
+		if err != nil {
+			return nil, err
+		}
+		ips[r.Type] = ip
+	}
+	return ips, nil
+}
+
+// specKey identifies the records that share a name and type.
+type specKey struct {
+	Name, Type string
+}
+
+// Change is a step planDomain found necessary to bring a zone in line
+// with the spec. Old is unset for creates, New is unset for deletes.
+type Change struct {
+	Action string
+	Old    Record
+	New    SpecRecord
+}
+
+// Actions a Change can have. actionNone marks a record that is already
+// as it should be, actionRefresh one that is but was last written longer
+// than -max-record-age ago.
+const (
+	actionNone    = "none"
+	actionCreate  = "create"
+	actionUpdate  = "update"
+	actionRefresh = "refresh"
+	actionDelete  = "delete"
+)
+
+var actionDone = map[string]string{
+	actionCreate:  "Created",
+	actionUpdate:  "Updated",
+	actionRefresh: "Refreshed",
+	actionDelete:  "Deleted",
+}
+
+// actionVerb and actionDoing name the actions -interactive asks about.
+var (
+	actionVerb = map[string]string{
+		actionCreate: "Create",
+		actionDelete: "Delete",
+	}
+	actionDoing = map[string]string{
+		actionCreate: "creating",
+		actionDelete: "deleting",
+	}
+)
+
+// reconcile moves the zones towards spec, creating missing records and
+// updating drifted ones. With -prune, records of a managed type that are
+// not in the spec are removed.
+func reconcile(ctx context.Context, spec *Spec) error {
+	var ips map[string]string
+	err := phase(ctx, "IP lookup", 0, func(ctx context.Context) (err error) {
+		ips, err = detectIPs(ctx, spec.Records)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return phase(ctx, "API update", *apiTimeout, func(ctx context.Context) error {
+		byDomain := spec.byDomain()
+		var domains []string
+		for domain := range byDomain {
+			domains = append(domains, domain)
+		}
+
+		// All domains are planned before any is changed, so -max-records
+		// can stop the update before it touches anything
+		var mu sync.Mutex
+		failed := 0
+		plans := make([][]Change, len(domains))
+		parallel(len(domains), func(i int) {
+			domain := domains[i]
+			var recs RecordSlice
+			var err error
+			withSlot(func() {
+				recs, err = listRecords(ctx, domain)
+			})
+			if err != nil {
+				logError("%s: Could not list records: %s", domain, err)
+				mu.Lock()
+				failed++
+				mu.Unlock()
+				return
+			}
+			plans[i] = planDomain(editable(domain, recs), byDomain[domain], ips, *prune)
+		})
+		var all []Change
+		for _, plan := range plans {
+			all = append(all, plan...)
+		}
+		if err := checkMaxRecords(countChanges(all)); err != nil {
+			return err
+		}
+
+		parallel(len(domains), func(i int) {
+			if plans[i] == nil {
+				return
+			}
+			if err := applyPlan(ctx, domains[i], plans[i]); err != nil {
+				logError("%s: %s", domains[i], err)
+				mu.Lock()
+				failed++
+				mu.Unlock()
+			}
+		})
+		if failed > 0 {
+			return fmt.Errorf("Reconciling failed for %d domains", failed)
+		}
+		return nil
+	})
+}
+
+// countChanges returns how many of changes write to the zone.
+func countChanges(changes []Change) int {
+	n := 0
+	for _, c := range changes {
+		if c.Action != actionNone {
+			n++
+		}
+	}
+	return n
+}
+
+// checkMaxRecords fails if an update would create, update or delete n
+// records, more than -max-records allows.
+func checkMaxRecords(n int) error {
+	if *maxRecords > 0 && n > *maxRecords {
+		return fmt.Errorf("Update would change %d records, more than -max-records %d allows. Nothing was changed", n, *maxRecords)
+	}
+	return nil
+}
+
+// applyPlan carries out the changes planDomain returned for domain.
+// Up to -concurrency changes are made at the same time.
+func applyPlan(ctx context.Context, domain string, changes []Change) error {
+	var todo []Change
+	for _, c := range changes {
+		if c.Action == actionNone {
+			logSkip(skipUnchanged, "%s record %s is up to date", c.New.Type, recordFQDN(c.New.Name, domain))
+			continue
+		}
+		todo = append(todo, c)
+	}
+
+	var mu sync.Mutex
+	failed := 0
+	parallel(len(todo), func(i int) {
+		c := todo[i]
+		var err error
+		withSlot(func() {
+			err = applyChange(ctx, domain, c)
+		})
+		if err == errDeclined {
+			return
+		}
+		if err != nil {
+			logError("Could not %s %s: %s", c.Action, describeChange(domain, c), err)
+			mu.Lock()
+			failed++
+			mu.Unlock()
+			return
+		}
+		logSuccess("%s %s", actionDone[c.Action], describeChange(domain, c))
+		if c.Action != actionDelete {
+			published(domain, c.New.Name, c.New.Type, c.New.Content)
+		}
+	})
+	if failed > 0 {
+		return fmt.Errorf("%d changes failed", failed)
+	}
+	return nil
+}
+
+// planDomain compares the records of a zone with the desired ones and
+// returns the changes needed to get from one to the other, including an
+// actionNone entry for each record that is already up to date. ips holds
+// the external IPs by record type as returned by detectIPs.
+func planDomain(recs RecordSlice, want []SpecRecord, ips map[string]string, prune bool) []Change {
+	// keys keeps the order of the spec so the plan is stable
+	var keys []specKey
+	desired := map[specKey][]SpecRecord{}
+	for _, r := range want {
+		if r.Content == autoContent {
+			if ips[r.Type] == "" {
+				continue
+			}
+			r.Content = ips[r.Type]
+		}
+		k := specKey{r.Name, r.Type}
+		if _, ok := desired[k]; !ok {
+			keys = append(keys, k)
+		}
+		desired[k] = append(desired[k], r)
+	}
+
+	managed := managedTypes(want)
+	existing := map[specKey]RecordSlice{}
+	for _, r := range recs {
+		if managed[r.Record.Type] {
+			k := specKey{r.Record.Name, r.Record.Type}
+			existing[k] = append(existing[k], r)
+		}
+	}
+
+	var changes []Change
+	for _, k := range keys {
+		want := desired[k]
+		have := existing[k]
+		delete(existing, k)
+
+		// Records that already carry the desired content only need their
+		// TTL checked. Whatever is left over is paired up and updated.
+		var unmatched []SpecRecord
+		for _, w := range want {
+			i := indexOfContent(have, w.Type, w.Content)
+			if i < 0 {
+				unmatched = append(unmatched, w)
+				continue
+			}
+			h := have[i]
+			have = append(have[:i], have[i+1:]...)
+			action := actionNone
+			switch {
+			case w.TTL != 0 && clampTTL(w.TTL) != h.Record.TTL || w.Priority != h.Record.Priority:
+				action = actionUpdate
+			case isStale(h):
+				action = actionRefresh
+			}
+			changes = append(changes, Change{Action: action, Old: h, New: w})
+		}
+		for _, w := range unmatched {
+			if len(have) == 0 {
+				changes = append(changes, Change{Action: actionCreate, New: w})
+				continue
+			}
+			changes = append(changes, Change{Action: actionUpdate, Old: have[0], New: w})
+			have = have[1:]
+		}
+		if len(have) > 0 {
+			existing[k] = have
+		}
+	}
+
+	if prune {
+		for _, r := range recs {
+			if indexOfID(existing[specKey{r.Record.Name, r.Record.Type}], r.Record.ID) >= 0 {
+				changes = append(changes, Change{Action: actionDelete, Old: r})
+			}
+		}
+	}
+	return changes
+}
+
+// applyChange makes c in domain, asking first with -interactive if it
+// creates or deletes a record.
+func applyChange(ctx context.Context, domain string, c Change) error {
+	if verb := actionVerb[c.Action]; verb != "" && !approve(verb+" "+describeChange(domain, c)) {
+		logSkip(skipDeclined, "Not %s %s", actionDoing[c.Action], describeChange(domain, c))
+		return errDeclined
+	}
+	payload := buildPayload(c.New.Name, c.New.Type, c.New.Content, c.New.TTL)
+	payload.Record.Priority = c.New.Priority
+	switch c.Action {
+	case actionCreate:
+		rec, err := createRecord(ctx, domain, payload)
+		recordHistory(c.New.Type, "", c.New.Content, "created", err)
+		if err == nil {
+			logInfo("Created record has ID %d", rec.Record.ID)
+			notifyChange(domain, c, rec.Record.ID)
+		}
+		return err
+	case actionUpdate, actionRefresh:
+		rec, err := replaceRecord(ctx, domain, c.Old, payload)
+		if err == errDeclined {
+			return err
+		}
+		recordHistory(c.New.Type, c.Old.Record.Content, c.New.Content, "updated", err)
+		if err == nil {
+			notifyChange(domain, c, rec.Record.ID)
+		}
+		return err
+	case actionDelete:
+		err := deleteRecord(ctx, domain, c.Old.Record.ID)
+		recordHistory(c.Old.Record.Type, c.Old.Record.Content, "", "deleted", err)
+		return err
+	}
+	return nil
+}
+
+// notifyChange sends an EventIPChanged for c, which wrote record id, if
+// it is an address record. Other records don't hold the external IP.
+func notifyChange(domain string, c Change, id int) {
+	if familyOf(c.New.Type) != 0 {
+		notifyIPChange(domain, c.New.Name, c.New.Type, id, c.Old.Record.Content, c.New.Content)
+	}
+}
+
+// describeChange returns a short human readable summary of c.
+func describeChange(domain string, c Change) string {
+	switch c.Action {
+	case actionCreate:
+		return fmt.Sprintf("%s record %s with %s", c.New.Type, recordFQDN(c.New.Name, domain), c.New.Content)
+	case actionUpdate:
+		same := sameContent(c.New.Type, c.Old.Record.Content, c.New.Content)
+		if same && c.Old.Record.Priority != c.New.Priority {
+			return fmt.Sprintf("priority of %s record %s from %d to %d", c.New.Type, recordFQDN(c.New.Name, domain), c.Old.Record.Priority, c.New.Priority)
+		}
+		if same {
+			return fmt.Sprintf("TTL of %s record %s from %d to %d", c.New.Type, recordFQDN(c.New.Name, domain), c.Old.Record.TTL, c.New.TTL)
+		}
+		return fmt.Sprintf("%s record %s from %s to %s", c.New.Type, recordFQDN(c.New.Name, domain), c.Old.Record.Content, c.New.Content)
+	case actionRefresh:
+		return fmt.Sprintf("%s record %s with %s, last written %s", c.New.Type, recordFQDN(c.New.Name, domain), c.New.Content, c.Old.Record.Updated)
+	case actionDelete:
+		return fmt.Sprintf("%s record %s (%s)", c.Old.Record.Type, recordFQDN(c.Old.Record.Name, domain), c.Old.Record.Content)
+	}
+	return fmt.Sprintf("%s record %s with %s", c.New.Type, recordFQDN(c.New.Name, domain), c.New.Content)
+}
+
+// isStale reports whether r was last written longer than -max-record-age
+// ago. Records without a readable updated_at are never stale.
+func isStale(r Record) bool {
+	if *maxRecordAge <= 0 {
+		return false
+	}
+	updated, err := time.Parse(time.RFC3339, r.Record.Updated)
+	return err == nil && time.Since(updated) > *maxRecordAge
+}
+
+// editable returns recs without the system records DNSimple manages
+// itself. Those of a type the updater could manage are logged as left
+// alone; SOA and NS records are dropped silently.
+func editable(domain string, recs RecordSlice) RecordSlice {
+	return recs.Where(func(r Record) bool {
+		if !r.Record.SystemRecord {
+			return true
+		}
+		if _, ok := recordTypes[r.Record.Type]; ok {
+			logSkip(skipSystemRecord, "%s record %s (ID %d) is a system record", r.Record.Type, recordFQDN(r.Record.Name, domain), r.Record.ID)
+		}
+		return false
+	})
+}
+
+func indexOfID(recs RecordSlice, id int) int {
+	for i, r := range recs {
+		if r.Record.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func indexOfContent(recs RecordSlice, typ, content string) int {
+	for i, r := range recs {
+		if sameContent(typ, r.Record.Content, content) {
+			return i
+		}
+	}
+	return -1
+}
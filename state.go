@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// KnownIP is an external IP and when it was last detected.
+type KnownIP struct {
+	IP   string    `json:"ip"`
+	Seen time.Time `json:"seen"`
+}
+
+// State is what is remembered between runs in -state-file.
+type State struct {
+	// IPs holds the last detected IP by family, 0 for either.
+	IPs map[int]KnownIP `json:"ips"`
+}
+
+var (
+	stateMu sync.Mutex
+	state   = State{IPs: map[int]KnownIP{}}
+)
+
+// loadState reads the state saved in path. A missing file is an empty
+// state.
+func loadState(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Could not read state file: %s", err)
+	}
+	s := State{}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("Invalid state file %s: %s", path, err)
+	}
+	if s.IPs == nil {
+		s.IPs = map[int]KnownIP{}
+	}
+	stateMu.Lock()
+	state = s
+	stateMu.Unlock()
+	return nil
+}
+
+// rememberIP notes that ip was detected for family, saving the state to
+// -state-file if set. Failing to save is only logged.
+func rememberIP(family int, ip string) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	state.IPs[family] = KnownIP{IP: ip, Seen: time.Now()}
+	if *stateFile == "" {
+		return
+	}
+	if err := saveState(*stateFile, state); err != nil {
+		logWarn("Could not save state: %s", err)
+	}
+}
+
+// knownIP returns the IP last detected for family, if any.
+func knownIP(family int) (KnownIP, bool) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	k, ok := state.IPs[family]
+	return k, ok
+}
+
+// saveState writes s to path, replacing the file at once so a crash
+// never leaves half of it behind.
+func saveState(path string, s State) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
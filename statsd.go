@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// statsd receives every metric update as well if -statsd is set.
+var statsd *StatsD
+
+// StatsD sends metric updates to a StatsD server over UDP. Counters are
+// sent as counters, histogram observations as timers in milliseconds.
+// Lost packets and send errors are ignored, as usual for StatsD.
+type StatsD struct {
+	prefix string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func NewStatsD(addr, prefix string) (*StatsD, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	return &StatsD{prefix: prefix, conn: conn}, nil
+}
+
+// Count adds n to the counter name, split by labelValue if set.
+func (s *StatsD) Count(name, labelValue string, n int) {
+	s.send(name, labelValue, fmt.Sprintf("%d|c", n))
+}
+
+// Timing records a duration of seconds for name, split by labelValue if
+// set.
+func (s *StatsD) Timing(name, labelValue string, seconds float64) {
+	s.send(name, labelValue, fmt.Sprintf("%.3f|ms", seconds*1000))
+}
+
+func (s *StatsD) send(name, labelValue, value string) {
+	if s == nil {
+		return
+	}
+	if labelValue != "" {
+		name += "." + statsdSafe(labelValue)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(s.conn, "%s%s:%s", s.prefix, name, value)
+}
+
+// statsdSafe replaces the characters StatsD uses as separators, and
+// anything else unusual in a metric name, with underscores.
+func statsdSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s)
+}
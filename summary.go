@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Summary aggregates what happened since startup for the periodic
+// summary line.
+type Summary struct {
+	mu      sync.Mutex
+	started time.Time
+	updates int
+	errors  int
+	ip      string
+}
+
+func NewSummary() *Summary {
+	return &Summary{started: time.Now()}
+}
+
+// Update counts a successful record change.
+func (s *Summary) Update() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updates++
+}
+
+// Error counts a failed update cycle.
+func (s *Summary) Error() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors++
+}
+
+// SetIP remembers the most recently detected external IP.
+func (s *Summary) SetIP(ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ip = ip
+}
+
+// Log writes the summary line, to stderr and syslog alike. It bypasses
+// -log-level so it can serve as a heartbeat even when only warnings are
+// logged.
+func (s *Summary) Log() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ip := s.ip
+	if ip == "" {
+		ip = "unknown"
+	}
+	output(levelInfo, "", fmt.Sprintf("Summary: %d updates, %d errors, current IP %s, up %s",
+		s.updates, s.errors, ip, time.Since(s.started).Truncate(time.Second)))
+}
+
+// logSummaries logs the summary every interval until stop is closed.
+func logSummaries(s *Summary, interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			s.Log()
+		}
+	}
+}
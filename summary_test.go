@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestSummaryLogLevel checks that the summary is logged even when only
+// warnings are.
+func TestSummaryLogLevel(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer func(level int) { minLevel = level }(minLevel)
+	minLevel = levelWarn
+
+	s := NewSummary()
+	s.Update()
+	s.SetIP("203.0.113.9")
+	s.Log()
+	logInfo("Not logged")
+	if got := buf.String(); !strings.Contains(got, "Summary: 1 updates, 0 errors, current IP 203.0.113.9") || strings.Contains(got, "Not logged") {
+		t.Errorf("Logged %q", got)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenRereads is how often -token-file is read again after the API
+// rejected its token before the token is taken to be bad for good.
+const tokenRereads = 3
+
+// tokenMu guards -t, which -token-file replaces while requests run, and
+// tokensRead, the tokens found in -token-file so far.
+var (
+	tokenMu    sync.Mutex
+	tokensRead = map[string]bool{}
+)
+
+// defaultToken returns the token of -t or -token-file.
+func defaultToken() string {
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	return *domainToken
+}
+
+// loadTokenFile sets -t to the token in -token-file, if given.
+func loadTokenFile() error {
+	if *tokenFile == "" {
+		return nil
+	}
+	if isSet("t") {
+		return fmt.Errorf("-t and -token-file can't both be set")
+	}
+	token, err := readToken(*tokenFile)
+	if err != nil {
+		return err
+	}
+	tokenMu.Lock()
+	*domainToken = token
+	tokensRead[token] = true
+	tokenMu.Unlock()
+	return nil
+}
+
+// fromTokenFile reports whether token was read from -token-file.
+func fromTokenFile(token string) bool {
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	return tokensRead[token]
+}
+
+func readToken(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Could not read -token-file: %s", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("-token-file %s is empty", path)
+	}
+	return token, nil
+}
+
+// rereadToken reads -token-file again and reports whether it holds a
+// different token than old, which it then uses from now on.
+func rereadToken(old string) (string, bool) {
+	token, err := readToken(*tokenFile)
+	if err != nil {
+		logWarn("%s", err)
+		return "", false
+	}
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	if token == old {
+		return "", false
+	}
+	*domainToken = token
+	tokensRead[token] = true
+	return token, true
+}
+
+// tokenTransport retries requests the API rejected with 401 once the
+// token in -token-file was replaced, as an outside process may rotate it.
+// A file that keeps the rejected token for tokenRereads reads in a row is
+// taken to hold a bad token and the 401 is passed on. The token itself is
+// never logged.
+type tokenTransport struct {
+	next http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	header, prefix := "X-DNSimple-Domain-Token", ""
+	if req.Header.Get("Authorization") != "" {
+		header, prefix = "Authorization", "Bearer "
+	}
+	used := strings.TrimPrefix(req.Header.Get(header), prefix)
+	if !fromTokenFile(used) {
+		// The token of a spec domain, which the file has nothing to do with
+		return resp, nil
+	}
+
+	for attempt := 1; ; attempt++ {
+		if token, changed := rereadToken(used); changed {
+			logInfo("Token rejected, retrying with the new one from -token-file")
+			retry := req.Clone(req.Context())
+			if req.GetBody != nil {
+				if retry.Body, err = req.GetBody(); err != nil {
+					return resp, nil
+				}
+			}
+			retry.Header.Set(header, prefix+token)
+			next, err := t.next.RoundTrip(retry)
+			if err != nil || next.StatusCode != http.StatusUnauthorized {
+				resp.Body.Close()
+				return next, err
+			}
+			resp.Body.Close()
+			resp, used = next, token
+		}
+		if attempt >= tokenRereads {
+			break
+		}
+		select {
+		case <-req.Context().Done():
+			return resp, nil
+		case <-time.After(backoff(attempt, 0)):
+		}
+	}
+	logError("Token from -token-file still rejected after reading it %d times, it seems to be invalid", tokenRereads)
+	return resp, nil
+}
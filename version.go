@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// version is the version of this build.
+const version = "1.0.0"
+
+// checkVersions asks url for the latest version every interval until stop
+// is closed and logs a notice if it is newer than the running one. It
+// only ever reads the version; nothing is downloaded.
+func checkVersions(url string, interval time.Duration, stop <-chan struct{}) {
+	c := &http.Client{Timeout: 30 * time.Second}
+	notified := ""
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		latest, err := latestVersion(c, url)
+		switch {
+		case err != nil:
+			logDebug("Could not check for a newer version: %s", err)
+		case newerVersion(latest, version) && latest != notified:
+			logInfo("Version %s is available, running %s", latest, version)
+			notified = latest
+		}
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// latestVersion fetches the latest version from url, which answers with
+// either a JSON object holding it as "version" or just the version.
+func latestVersion(c *http.Client, url string) (string, error) {
+	resp, err := c.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", err
+	}
+	v := strings.TrimSpace(string(body))
+	if strings.HasPrefix(v, "{") {
+		var obj struct {
+			Version string `json:"version"`
+		}
+		if err := json.Unmarshal(body, &obj); err != nil {
+			return "", err
+		}
+		v = obj.Version
+	}
+	v = strings.TrimPrefix(v, "v")
+	if _, ok := parseVersion(v); !ok {
+		return "", fmt.Errorf("%s returned invalid version %q", url, v)
+	}
+	return v, nil
+}
+
+// newerVersion reports whether version a is newer than b.
+func newerVersion(a, b string) bool {
+	va, _ := parseVersion(a)
+	vb, _ := parseVersion(b)
+	for i := 0; i < len(va) || i < len(vb); i++ {
+		var x, y int
+		if i < len(va) {
+			x = va[i]
+		}
+		if i < len(vb) {
+			y = vb[i]
+		}
+		if x != y {
+			return x > y
+		}
+	}
+	return false
+}
+
+// parseVersion splits a dotted version like 1.2.3 into its numbers.
+func parseVersion(v string) ([]int, bool) {
+	var nums []int
+	for _, part := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		nums = append(nums, n)
+	}
+	return nums, true
+}
@@ -0,0 +1,37 @@
+package main
+
+import "sync"
+
+// apiSlots bounds how many records are listed or changed at the same
+// time to -concurrency.
+var apiSlots = make(chan struct{}, 1)
+
+// setupWorkers resizes apiSlots to n. Work that is still running on the
+// old slots finishes there.
+func setupWorkers(n int) {
+	if cap(apiSlots) != n {
+		apiSlots = make(chan struct{}, n)
+	}
+}
+
+// withSlot runs fn once one of the -concurrency slots is free.
+func withSlot(fn func()) {
+	slots := apiSlots
+	slots <- struct{}{}
+	defer func() { <-slots }()
+	fn()
+}
+
+// parallel runs fn for each i from 0 to n in its own goroutine and waits
+// for all of them. fn is expected to take a slot for its API requests.
+func parallel(n int, fn func(i int)) {
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}